@@ -1,29 +1,143 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	_ "net/http/pprof"
 	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 var (
-	fqdn    = "test.domain.com"
-	port    = "443"
-	org     = "123"
-	user    = "api_123"
-	key     = "123456abcdef"
-	verbose bool
+	fqdn       = "test.domain.com"
+	port       = "443"
+	org        = "123"
+	user       = "api_123"
+	key        = "123456abcdef"
+	verbose    bool
+	strict     bool
+	prettyJSON bool
 )
 
+// Config holds the PCE connection settings read from a -config file.
+type Config struct {
+	FQDN string `json:"fqdn"`
+	Port string `json:"port"`
+	Org  string `json:"org"`
+	User string `json:"user"`
+	Key  string `json:"key"`
+
+	// ServiceConcurrency caps concurrent queries per service name. The
+	// global cap still applies, so a service runs at most
+	// min(its limit, global cap) queries at once.
+	ServiceConcurrency map[string]int `json:"service_concurrency"`
+
+	// Concurrency is the global cap on concurrent traffic queries and
+	// Timeout the per-request HTTP timeout ("45s"); zero values keep the
+	// defaults.
+	Concurrency int    `json:"concurrency"`
+	Timeout     string `json:"timeout"`
+}
+
+// PCEClient holds the connection settings of one PCE.
+type PCEClient struct {
+	FQDN string
+	Port string
+	Org  string
+	User string
+	Key  string
+}
+
+// apiVersion is -api-version, the path segment after /api/ in every URL.
+var apiVersion = "v2"
+
+// pceURL builds the URL of an API path such as an href ("/orgs/1/..."),
+// owning scheme, host, port and API version; query may be nil.
+func (c *PCEClient) pceURL(path string, query url.Values) string {
+	u := url.URL{
+		Scheme:   "https",
+		Host:     net.JoinHostPort(c.FQDN, c.Port),
+		Path:     "/api/" + apiVersion + path,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// orgURL is pceURL for a path under the client's org.
+func (c *PCEClient) orgURL(path string, query url.Values) string {
+	return c.pceURL("/orgs/"+c.Org+path, query)
+}
+
+// validatePort checks a PCE port is a number in 1-65535.
+func validatePort(p string) error {
+	n, err := strconv.Atoi(p)
+	if err != nil {
+		return fmt.Errorf("%q is not numeric", p)
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("%d out of range 1-65535", n)
+	}
+	return nil
+}
+
+// policyPCE serves labels, services and all rule writes; queryPCE serves
+// traffic queries. Both point at the same PCE unless -query-* flags are set.
+var policyPCE, queryPCE *PCEClient
+
+func (c *PCEClient) String() string {
+	return fmt.Sprintf("%s:%s (org %s)", c.FQDN, c.Port, c.Org)
+}
+
+// ping checks the PCE is reachable and accepts our credentials.
+func (c *PCEClient) ping() error {
+	urlStr := c.orgURL("/labels", url.Values{"key": {"env"}, "max_results": {"1"}})
+	if _, err := apiRequestWithRetry(context.Background(), c, "GET", urlStr, nil); err != nil {
+		var se *httpStatusError
+		if errors.As(err, &se) && se.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("authentication failed for API user %s on PCE %s: check user and key", c.User, c)
+		}
+		if errors.As(err, &se) && se.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("API user %s is not authorized for org %s on PCE %s", c.User, c.Org, c)
+		}
+		return fmt.Errorf("PCE %s unreachable: %w", c, err)
+	}
+	return nil
+}
+
+type configFile struct {
+	Config
+	Profiles map[string]Config `json:"profiles"`
+}
+
 type Label struct {
 	Href  string `json:"href"`
 	Key   string `json:"key"`
@@ -42,375 +156,4219 @@ type Service struct {
 	ServicePorts []ServicePort `json:"service_ports"`
 }
 
+// appScope is one app label plus the extra provider dimensions (loc, role)
+// shared by the workloads carrying it.
+type appScope struct {
+	app    Label
+	extras []Label
+}
+
 type denyRuleInfo struct {
 	env     Label
 	service Service
 	apps    []Label
-}
+	extras  []Label
 
-var (
-	totalDenyRules int64
-	doneDenyRules  int64
-)
+	// part/parts number the rules an (env, service) was split into by
+	// -max-apps-per-rule
+	part, parts int
 
-var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
+	// egress rules deny the workloads' outbound traffic to the IP-list;
+	// ingress rules (the default) deny traffic from it
+	egress bool
 }
 
-func vlog(format string, v ...interface{}) {
-	if verbose {
-		log.Printf(format, v...)
+func (dr denyRuleInfo) direction() string {
+	if dr.egress {
+		return "egress"
 	}
+	return "ingress"
 }
 
-func printProgress(done, total int64) {
-	percent := float64(done) / float64(total) * 100
-	log.Printf("Progress: %.1f%% (%d/%d)", percent, done, total)
-}
-
-func apiRequestWithRetry(method, urlStr string, payload interface{}) ([]byte, error) {
-	var body []byte
-	if payload != nil {
-		var err error
-		body, err = json.Marshal(payload)
-		if err != nil {
-			return nil, err
-		}
-		vlog("Payload: %s", string(body))
+// reference is the rule's ruleReference. Egress rules hash differently so
+// they never match the ingress rule for the same scope.
+func (dr denyRuleInfo) reference(ipListHrefs []string) string {
+	labels := providerLabels(dr.env, dr.extras, dr.apps)
+	ipLists := ipListSetKey(ipListHrefs)
+	if dr.egress {
+		return ruleReference(labels, dr.service.Href, ipLists+"|egress")
 	}
+	return ruleReference(labels, dr.service.Href, ipLists)
+}
 
-	var lastErr error
-	retries := 3
-	for i := 0; i < retries; i++ {
-		req, err := http.NewRequest(method, urlStr, bytes.NewBuffer(body))
-		if err != nil {
-			return nil, err
-		}
-		req.SetBasicAuth(user, key)
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept", "application/json")
+// ipListSetKey is the order-independent key of a set of IP-list hrefs; for
+// a single list it is the href itself.
+func ipListSetKey(hrefs []string) string {
+	sorted := append([]string(nil), hrefs...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
 
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			lastErr = err
-		} else {
-			defer resp.Body.Close()
-			data, _ := ioutil.ReadAll(resp.Body)
-			vlog("Response Status: %s", resp.Status)
-			vlog("RAW RESPONSE BODY: %s", string(data))
+// ruleDirection is -direction: ingress, egress or both.
+var ruleDirection = "ingress"
 
-			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				return data, nil
-			}
-			lastErr = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(data))
-		}
-		time.Sleep(time.Duration(1<<i)*time.Second + time.Duration(rand.Intn(500))*time.Millisecond)
+// egressDirections lists, per direction in -direction, whether it is egress.
+func egressDirections() []bool {
+	switch ruleDirection {
+	case "egress":
+		return []bool{true}
+	case "both":
+		return []bool{false, true}
 	}
-	return nil, fmt.Errorf("apiRequest failed after %d retries: %v", retries, lastErr)
+	return []bool{false}
 }
 
-func getEnvs() ([]Label, error) {
-	urlStr := fmt.Sprintf("https://%s:%s/api/v2/orgs/%s/labels?key=env", fqdn, port, org)
-	data, err := apiRequestWithRetry("GET", urlStr, nil)
-	if err != nil {
-		return nil, fmt.Errorf("getEnvs: %w", err)
-	}
-	var labels []Label
-	if err := json.Unmarshal(data, &labels); err != nil {
-		return nil, fmt.Errorf("getEnvs unmarshal: %w", err)
+// withDirections turns each planned rule into one rule per -direction.
+func withDirections(rules []denyRuleInfo) []denyRuleInfo {
+	var out []denyRuleInfo
+	for _, dr := range rules {
+		for _, egress := range egressDirections() {
+			dr.egress = egress
+			out = append(out, dr)
+		}
 	}
-	return labels, nil
+	return out
 }
 
-func getRansomServices() ([]Service, error) {
-	urlStr := fmt.Sprintf("https://%s:%s/api/v2/orgs/%s/sec_policy/draft/services?is_ransomware=true", fqdn, port, org)
-	data, err := apiRequestWithRetry("GET", urlStr, nil)
-	if err != nil {
-		return nil, fmt.Errorf("getRansomServices: %w", err)
-	}
-	var services []Service
-	if err := json.Unmarshal(data, &services); err != nil {
-		return nil, fmt.Errorf("getRansomServices unmarshal: %w", err)
-	}
-	return services, nil
-}
+var useWorkloadSubnets []string
 
-func getWorkloadsForEnv(env Label) ([]Label, error) {
-	urlStr := fmt.Sprintf(
-		"https://%s:%s/api/v2/orgs/%s/workloads?managed=true&online=true&labels=[[\"%s\"]]&enforcement_modes=[\"idle\",\"selective\",\"visibility_only\"]",
-		fqdn, port, org, env.Href,
-	)
-	vlog("Fetching workloads for env %s", env.Value)
+var serviceConcurrency map[string]int
 
-	data, err := apiRequestWithRetry("GET", urlStr, nil)
-	if err != nil {
-		return nil, fmt.Errorf("getWorkloadsForEnv %s: %w", env.Value, err)
-	}
+// queryConcurrency caps concurrent traffic queries across all services.
+var queryConcurrency = 2
 
-	var workloads []struct {
-		Labels []Label `json:"labels"`
+// maxConcurrency is where -concurrency and -create-concurrency are clamped.
+// The PCE has its own ceiling on running async queries per tenant and
+// answers 429 above it.
+const maxConcurrency = 16
+
+const externalDataSet = "auto-deny-rules"
+
+// -rule-description(-template); {env}, {service}, {apps} and {run_id} are
+// replaced per rule
+var ruleDescriptionTemplate = defaultRuleDescription
+
+const defaultRuleDescription = "Created by auto-deny-rules run {run_id}"
+
+// ruleTag is -rule-tag, e.g. a change ticket, prefixed to each rule's
+// external_data_reference.
+var ruleTag string
+
+// maxRuleTagLen keeps tag + ":" + 32-char reference within the PCE's
+// 255-character external_data_reference.
+const maxRuleTagLen = 222
+
+// runID identifies this run in saved queries and reports.
+var runID = fmt.Sprintf("%s-%04x", time.Now().Format("20060102-150405"), rand.IntN(0x10000))
+
+// decision categories that count as traffic; empty means all of them
+var (
+	policyDecisions   = []string{}
+	boundaryDecisions = []string{}
+)
+
+var (
+	allowedPolicyDecisions   = []string{"allowed", "potentially_blocked", "blocked", "unknown"}
+	allowedBoundaryDecisions = []string{"blocked", "blocked_by_override_deny", "blocked_non_illumio_rule"}
+)
+
+// resolve_labels_as for query sources/destinations; empty leaves the PCE
+// default in place
+var (
+	resolveSourcesAs      []string
+	resolveDestinationsAs []string
+)
+
+var allowedResolveLabelsAs = []string{"workloads", "container_hosts"}
+
+// extra workload filters; apps only seen on filtered-out workloads are
+// never evaluated
+var (
+	workloadParams url.Values
+	hostnameFilter *regexp.Regexp
+)
+
+// includeUnlabeled is -include-unlabeled: an env whose workloads carry no
+// app label at all is analyzed as one env-wide scope.
+var includeUnlabeled bool
+
+// labelGroup is a resolved -label-group: an app label group and the hrefs
+// of the app labels it contains, sub-groups included.
+type labelGroup struct {
+	Href    string
+	Name    string
+	members map[string]bool
+}
+
+// labelGroups are the -label-group groups. A deny rule whose apps cover
+// every member of a group names the group instead of its member labels.
+var labelGroups []labelGroup
+
+// groupProviders splits a rule's provider labels into the labels emitted
+// one by one and the label groups that replace the rest.
+func groupProviders(dr denyRuleInfo) ([]Label, []labelGroup) {
+	labels := providerLabels(dr.env, dr.extras, dr.apps)
+	if len(labelGroups) == 0 {
+		return labels, nil
 	}
-	if err := json.Unmarshal(data, &workloads); err != nil {
-		return nil, fmt.Errorf("getWorkloadsForEnv unmarshal: %w", err)
+	apps := make(map[string]bool, len(dr.apps))
+	for _, a := range dr.apps {
+		apps[a.Href] = true
 	}
-
-	uniqueApps := make(map[string]Label)
-	for _, w := range workloads {
-		for _, l := range w.Labels {
-			if l.Key == "app" {
-				uniqueApps[l.Href] = l
+	covered := make(map[string]bool)
+	var groups []labelGroup
+	for _, g := range labelGroups {
+		if len(g.members) == 0 {
+			continue
+		}
+		whole := true
+		for href := range g.members {
+			if !apps[href] {
+				whole = false
+				break
 			}
 		}
+		if !whole {
+			continue
+		}
+		groups = append(groups, g)
+		for href := range g.members {
+			covered[href] = true
+		}
 	}
-	apps := make([]Label, 0, len(uniqueApps))
-	for _, l := range uniqueApps {
-		apps = append(apps, l)
+	if len(groups) == 0 {
+		return labels, nil
 	}
-	return apps, nil
+	var rest []Label
+	for _, l := range labels {
+		if !covered[l.Href] {
+			rest = append(rest, l)
+		}
+	}
+	return rest, groups
 }
 
-func submitTrafficQuery(
-	envHref, appHref string,
-	service Service,
-	excludeBroadcast, excludeMulticast bool,
-) (bool, error) {
-	now := time.Now().UTC()
-	start24h := now.Add(-24 * time.Hour).Format(time.RFC3339)
-	start89d := now.Add(-89 * 24 * time.Hour).Format(time.RFC3339)
-	end := now.Format(time.RFC3339)
+// reserved workload query parameters the tool sets itself
+var reservedWorkloadParams = []string{"managed", "online", "labels", "enforcement_modes"}
 
-	var ports []map[string]interface{}
-	for _, sp := range service.ServicePorts {
-		p := map[string]interface{}{
-			"port":  sp.Port,
-			"proto": sp.Proto,
-		}
-		if sp.ToPort != 0 {
-			p["to_port"] = sp.ToPort
-		}
-		ports = append(ports, p)
-	}
+// hrefs of IP-lists whose traffic never counts as "has traffic"
+var excludedSourceIPLists []string
 
-	payload := func(start string) map[string]interface{} {
-		return map[string]interface{}{
-			"sources": map[string]interface{}{
-				"include": []interface{}{[]interface{}{}},
-				"exclude": []interface{}{},
-			},
-			"destinations": map[string]interface{}{
-				"include": [][]map[string]map[string]string{
-					{{"label": {"href": envHref}}, {"label": {"href": appHref}}},
-				},
-				"exclude": buildDestExclusions(excludeBroadcast, excludeMulticast),
-			},
-			"services": map[string]interface{}{
-				"include": ports,
-				"exclude": []interface{}{},
-			},
-			"sources_destinations_query_op": "and",
-			"start_date":                    start,
-			"end_date":                      end,
-			"policy_decisions":              []string{},
-			"boundary_decisions":            []string{},
-			"query_name": fmt.Sprintf(
-				"Query Env: %s App: %s", envHref, appHref,
-			),
-			"exclude_workloads_from_ip_list_query": true,
-			"max_results":                          1,
-		}
-	}
+// CIDRs (e.g. known scanner subnets) whose traffic never counts as "has traffic"
+var excludedSourceCIDRs []string
 
-	url := fmt.Sprintf("https://%s:%s/api/v2/orgs/%s/traffic_flows/async_queries", fqdn, port, org)
+// traffic lookback windows: the short one is queried first and the long one
+// only when the short one had no flows
+var (
+	shortWindow = 24 * time.Hour
+	longWindow  = 89 * 24 * time.Hour
+)
 
-	// 24-hour query
-	if hasFlows, err := runSingleAsyncQuery(url, payload(start24h)); err != nil {
-		return false, err
-	} else if hasFlows {
-		return false, nil
-	}
+var (
+	providerDimensions = []string{"env", "app"}
+	optionalDimensions = []string{"loc", "role"}
+)
 
-	// 89-day query - only reached when 24h had no traffic
-	if hasFlows, err := runSingleAsyncQuery(url, payload(start89d)); err != nil {
-		return false, err
-	} else if hasFlows {
-		return false, nil
-	}
+type envInfo struct {
+	env  Label
+	apps []appScope
+}
 
-	// both windows reported zero flows → safe to deny
-	return true, nil
+type skippedEnv struct {
+	Env    string `json:"env"`
+	Href   string `json:"href"`
+	Reason string `json:"reason"`
 }
 
-func runSingleAsyncQuery(baseURL string, payload map[string]interface{}) (bool, error) {
-	respBytes, err := apiRequestWithRetry("POST", baseURL, payload)
-	if err != nil {
-		return false, err
-	}
-	var resp map[string]interface{}
-	if err := json.Unmarshal(respBytes, &resp); err != nil {
-		return false, err
-	}
-	href, ok := resp["href"].(string)
-	if !ok || href == "" {
-		return false, fmt.Errorf("query failed to return href")
-	}
+// queryCombo is one (env, service) pair whose apps are queried together.
+type queryCombo struct {
+	ei      envInfo
+	service Service
+}
 
-	timeout := time.After(5 * time.Minute)
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+var (
+	totalDenyRules int64
+	doneDenyRules  int64
+)
 
-	for {
-		select {
-		case <-timeout:
-			return false, fmt.Errorf("query timed out after 5 minutes")
-		case <-ticker.C:
-			pollBytes, err := apiRequestWithRetry("GET",
-				fmt.Sprintf("https://%s:%s/api/v2%s", fqdn, port, href), nil)
-			if err != nil {
-				return false, err
-			}
-			var poll map[string]interface{}
-			if err := json.Unmarshal(pollBytes, &poll); err != nil {
-				return false, err
-			}
-			status, _ := poll["status"].(string)
-			flowsCount, _ := poll["flows_count"].(float64)
+// httpStatusError is returned by apiRequestWithRetry for non-2xx responses.
+// Only 5xx and 429 are retried; other statuses are returned at once.
+type httpStatusError struct {
+	StatusCode int
+	Body       string
+}
 
-			if status == "completed" {
-				return flowsCount > 0, nil
-			}
-		}
-	}
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Body)
 }
 
-func createRuleset(name string) (string, error) {
-	payload := map[string]interface{}{
-		"name":        name,
-		"description": "Created by Auto Deny Rules script.",
-		"scopes":      [][]interface{}{{}},
+var (
+	labelCacheMu sync.Mutex
+	labelCache   = make(map[string]bool)
+)
+
+var (
+	retryAttempts    = 3
+	retryBackoffBase = time.Second
+	retryMaxBackoff  = 30 * time.Second
+	retryJitter      = 0.5
+)
+
+var httpClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// newTransport builds the HTTP transport for -insecure, -ca-bundle and
+// -proxy. Without -proxy, HTTPS_PROXY/HTTP_PROXY and NO_PROXY are honored.
+func newTransport(insecure bool, caBundle, proxy string) (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyFromEnvironment
+	if proxy != "" {
+		u, err := url.Parse(proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("newTransport: invalid proxy URL %q", proxy)
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if insecure {
+		log.Printf("WARNING: -insecure set, TLS certificate verification is DISABLED; do not use against production PCEs")
+		if caBundle != "" {
+			log.Printf("WARNING: -ca-bundle %s ignored because -insecure is set", caBundle)
+		}
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		return t, nil
 	}
-	url := fmt.Sprintf("https://%s:%s/api/v2/orgs/%s/sec_policy/draft/rule_sets", fqdn, port, org)
-	data, err := apiRequestWithRetry("POST", url, payload)
+	if caBundle == "" {
+		return t, nil
+	}
+	pem, err := os.ReadFile(caBundle)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("newTransport: %w", err)
 	}
-	var resp map[string]interface{}
-	if err := json.Unmarshal(data, &resp); err != nil {
-		return "", err
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("newTransport: no valid PEM certificates in %s", caBundle)
 	}
-	href, _ := resp["href"].(string)
-	return href, nil
+	t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return t, nil
 }
 
-func createDenyRule(
-	rulesetHref string,
-	serviceHref string,
-	apps []Label,
-	env Label,
-	ipListHref string,
-) error {
-	providers := []map[string]map[string]string{
-		{"label": {"href": env.Href}},
+// loadConfig reads a JSON config file. Top-level settings are shared
+// defaults; a named profile overrides them field by field.
+func loadConfig(path, profile string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("loadConfig: %w", err)
 	}
-	for _, a := range apps {
-		providers = append(providers, map[string]map[string]string{
-			"label": {"href": a.Href},
-		})
+	var cf configFile
+	if err := json.Unmarshal(data, &cf); err != nil {
+		return Config{}, fmt.Errorf("loadConfig %s: %w", path, err)
 	}
-
-	payload := map[string]interface{}{
-		"providers": providers,
-		"consumers": []map[string]map[string]string{
-			{"ip_list": {"href": ipListHref}},
-		},
-		"enabled": true,
-		"ingress_services": []map[string]string{
-			{"href": serviceHref},
-		},
-		"egress_services": []interface{}{},
-		"network_type":    "brn",
-		"description":     "",
+	cfg := cf.Config
+	if profile != "" {
+		p, ok := cf.Profiles[profile]
+		if !ok {
+			names := make([]string, 0, len(cf.Profiles))
+			for name := range cf.Profiles {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return Config{}, fmt.Errorf("profile %q not found in %s (available: %s)",
+				profile, path, strings.Join(names, ", "))
+		}
+		cfg = mergeConfig(cf.Config, p)
 	}
+	// the environment overrides the file; required fields are only checked
+	// by checkRequired once flags are merged too
+	cfg = mergeConfig(cfg, envConfig())
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("loadConfig %s: %w", path, err)
+	}
+	return cfg, nil
+}
 
-	url := fmt.Sprintf("https://%s:%s/api/v2%s/deny_rules", fqdn, port, rulesetHref)
-	_, err := apiRequestWithRetry("POST", url, payload)
-	return err
+// checkRequired reports the first missing connection field by its JSON name.
+func (c Config) checkRequired() error {
+	required := []struct{ name, value string }{
+		{"fqdn", c.FQDN}, {"port", c.Port}, {"org", c.Org}, {"user", c.User}, {"key", c.Key},
+	}
+	for _, f := range required {
+		if f.value == "" {
+			return fmt.Errorf("missing required field %q", f.name)
+		}
+	}
+	return nil
 }
 
-func getIPListHref(targetName string) (string, error) {
-	escapedName := url.QueryEscape(targetName)
-	urlStr := fmt.Sprintf(
-		"https://%s:%s/api/v2/orgs/%s/sec_policy/draft/ip_lists?max_results=500&name=%s",
-		fqdn, port, org, escapedName,
-	)
+// validate rejects bad optional settings.
+func (c Config) validate() error {
+	if c.Concurrency < 0 {
+		return fmt.Errorf("invalid concurrency %d (must be >= 1)", c.Concurrency)
+	}
+	if c.Timeout != "" {
+		if d, err := time.ParseDuration(c.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("invalid timeout %q (want a positive duration like \"45s\")", c.Timeout)
+		}
+	}
+	for name, n := range c.ServiceConcurrency {
+		if n < 1 {
+			return fmt.Errorf("invalid service_concurrency for %q: %d (must be >= 1)", name, n)
+		}
+	}
+	return nil
+}
 
-	data, err := apiRequestWithRetry("GET", urlStr, nil)
-	if err != nil {
-		return "", err
+func mergeConfig(base, over Config) Config {
+	if over.FQDN != "" {
+		base.FQDN = over.FQDN
 	}
-	var lists []struct {
-		Href string `json:"href"`
-		Name string `json:"name"`
+	if over.Port != "" {
+		base.Port = over.Port
 	}
-	if err := json.Unmarshal(data, &lists); err != nil {
-		return "", err
+	if over.Org != "" {
+		base.Org = over.Org
+	}
+	if over.User != "" {
+		base.User = over.User
+	}
+	if over.Key != "" {
+		base.Key = over.Key
+	}
+	if len(over.ServiceConcurrency) > 0 {
+		merged := make(map[string]int, len(base.ServiceConcurrency)+len(over.ServiceConcurrency))
+		for name, n := range base.ServiceConcurrency {
+			merged[name] = n
+		}
+		for name, n := range over.ServiceConcurrency {
+			merged[name] = n
+		}
+		base.ServiceConcurrency = merged
+	}
+	if over.Concurrency != 0 {
+		base.Concurrency = over.Concurrency
 	}
-	if len(lists) == 0 {
-		return "", fmt.Errorf("no IP-list found with name %q", targetName)
+	if over.Timeout != "" {
+		base.Timeout = over.Timeout
 	}
-	return lists[0].Href, nil
+	return base
 }
 
-func buildDestExclusions(broadcast, multicast bool) []interface{} {
-	excl := make([]interface{}, 0)
-	if broadcast {
-		excl = append(excl, map[string]string{"transmission": "broadcast"})
+// connEnv maps each connection setting to the environment variable that
+// overrides it.
+var connEnv = []struct{ field, env string }{
+	{"fqdn", "PCE_FQDN"}, {"port", "PCE_PORT"}, {"org", "PCE_ORG"},
+	{"user", "PCE_API_USER"}, {"key", "PCE_API_KEY"},
+}
+
+// envConfig reads the connection settings set in the environment.
+func envConfig() Config {
+	return Config{
+		FQDN: os.Getenv("PCE_FQDN"),
+		Port: os.Getenv("PCE_PORT"),
+		Org:  os.Getenv("PCE_ORG"),
+		User: os.Getenv("PCE_API_USER"),
+		Key:  os.Getenv("PCE_API_KEY"),
 	}
-	if multicast {
-		excl = append(excl, map[string]string{"transmission": "multicast"})
+}
+
+// connSources records where each connection setting came from, for -verbose.
+var connSources = map[string]string{}
+
+// applyConfig copies the non-empty config values over the compiled defaults.
+func applyConfig(c Config) {
+	// merging over the current limits keeps an earlier file's
+	// service_concurrency when a later layer (flags) has none
+	c = mergeConfig(Config{FQDN: fqdn, Port: port, Org: org, User: user, Key: key,
+		ServiceConcurrency: serviceConcurrency}, c)
+	fqdn, port, org, user, key = c.FQDN, c.Port, c.Org, c.User, c.Key
+	serviceConcurrency = c.ServiceConcurrency
+	if c.Concurrency > 0 {
+		queryConcurrency = c.Concurrency
+	}
+	if d, err := time.ParseDuration(c.Timeout); err == nil {
+		httpClient.Timeout = d
 	}
-	return excl
 }
 
-func logQueryProgress(env, app Label, svc Service, done, total int64) {
-	percent := float64(done) / float64(total) * 100
-	log.Printf("[Query] Env:%s  App:%s  Service:%s  →  Progress: %.1f%% (%d/%d)",
-		env.Value, app.Value, svc.Name, percent, done, total)
+// logSink is one destination for log lines, either in the standard log
+// layout or as one JSON object per line.
+type logSink struct {
+	w    io.Writer
+	json bool
+}
+
+// logSinks[0] is the terminal. It is stderr, not stdout, so stdout only
+// carries machine-readable output (RESULT, -output-ndjson).
+var (
+	logMu    sync.Mutex
+	logSinks = []logSink{{w: os.Stderr}}
+)
+
+// logEvent writes one log line to every sink; logMu keeps lines from
+// concurrent goroutines whole across all sinks.
+func logEvent(level string, fields map[string]interface{}, msg string) {
+	writeEvent(true, level, fields, msg)
+}
+
+// writeEvent is logEvent; without terminal it skips the terminal sink,
+// logSinks[0], for events the progress bar shows there instead.
+func writeEvent(terminal bool, level string, fields map[string]interface{}, msg string) {
+	now := time.Now()
+	msg = redact(maskSecrets(msg))
+	logMu.Lock()
+	defer logMu.Unlock()
+	sinks := logSinks[1:]
+	if terminal {
+		sinks = logSinks
+		if barDrawn {
+			// clear the progress bar so the line doesn't land on top of it
+			fmt.Fprint(os.Stderr, "\r\033[K")
+			barDrawn = false
+		}
+	}
+	for _, s := range sinks {
+		if !s.json {
+			fmt.Fprintf(s.w, "%s %s\n", now.Format("2006/01/02 15:04:05"), msg)
+			continue
+		}
+		entry := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": level,
+			"msg":   msg,
+		}
+		for k, v := range fields {
+			if str, ok := v.(string); ok {
+				v = redact(maskSecrets(str))
+			}
+			entry[k] = v
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		s.w.Write(append(data, '\n'))
+	}
+}
+
+var (
+	redactLogs   bool
+	redactSalt   = strconv.FormatInt(time.Now().UnixNano(), 36)
+	redactMu     sync.Mutex
+	redactValues = make(map[string]string)
+	redactRe     *regexp.Regexp
+	hrefRe       = regexp.MustCompile(`/orgs/\d+(/[A-Za-z0-9_\-]+)+`)
+	ipRe         = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(/\d{1,2})?\b`)
+	// ip6Re over-matches (times, MACs); redact keeps what isn't an address
+	ip6Re = regexp.MustCompile(`(?i)(?:[0-9a-f]{0,4}:){2,7}[0-9a-f]{0,4}(?:/\d{1,3})?`)
+)
+
+// redactToken maps a sensitive string to a stable per-run token, so a
+// redacted log can still be correlated line to line.
+func redactToken(kind, s string) string {
+	sum := sha256.Sum256([]byte(redactSalt + s))
+	return kind + "-" + hex.EncodeToString(sum[:4])
+}
+
+// redactRegister adds label values (or other names) that -redact masks.
+func redactRegister(kind string, values ...string) {
+	if !redactLogs {
+		return
+	}
+	redactMu.Lock()
+	defer redactMu.Unlock()
+	changed := false
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		if _, ok := redactValues[v]; !ok {
+			redactValues[v] = redactToken(kind, v)
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	quoted := make([]string, 0, len(redactValues))
+	for v := range redactValues {
+		quoted = append(quoted, regexp.QuoteMeta(v))
+	}
+	// longest first so "Prod-EU" wins over "Prod". A value only counts as a
+	// whole token, so "web" leaves "web-frontend" alone; no \b, since values
+	// may start or end with punctuation, as in "Prod (EU)".
+	sort.Slice(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	redactRe = regexp.MustCompile(`(?:^|[\s"'()\[\]{},;:=|/@?&])(` + strings.Join(quoted, "|") + `)(?:$|[\s"'()\[\]{},;:=|/@?&])`)
+}
+
+// isTokenDelim reports whether c may separate a label value from its
+// surroundings in a log line; the same set as in redactRe.
+func isTokenDelim(c byte) bool {
+	return strings.IndexByte(" \t\n\r\f\v\"'()[]{},;:=|/@?&", c) >= 0
+}
+
+// redactTokens replaces each value matched by re with its token. Matching
+// resumes right after a value, so the delimiter ending one value can start
+// the next.
+func redactTokens(re *regexp.Regexp, s string, token func(string) string) string {
+	var b strings.Builder
+	p := 0
+	for p < len(s) {
+		m := re.FindStringSubmatchIndex(s[p:])
+		if m == nil {
+			break
+		}
+		start, end := p+m[2], p+m[3]
+		if start == p && p > 0 && !isTokenDelim(s[p-1]) {
+			// ^ matched mid-string, where no delimiter precedes the value
+			b.WriteByte(s[p])
+			p++
+			continue
+		}
+		b.WriteString(s[p:start])
+		b.WriteString(token(s[start:end]))
+		p = end
+	}
+	b.WriteString(s[p:])
+	return b.String()
+}
+
+// secrets are masked in every log line regardless of -redact.
+var secrets []string
+
+func maskSecrets(s string) string {
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, "[REDACTED]")
+	}
+	return s
+}
+
+func redact(s string) string {
+	if !redactLogs {
+		return s
+	}
+	s = hrefRe.ReplaceAllStringFunc(s, func(m string) string { return redactToken("href", m) })
+	s = ipRe.ReplaceAllStringFunc(s, func(m string) string { return redactToken("ip", m) })
+	s = ip6Re.ReplaceAllStringFunc(s, func(m string) string {
+		if addr, _, _ := strings.Cut(m, "/"); net.ParseIP(addr) == nil {
+			return m
+		}
+		return redactToken("ip", m)
+	})
+	redactMu.Lock()
+	re := redactRe
+	redactMu.Unlock()
+	if re != nil {
+		s = redactTokens(re, s, func(v string) string {
+			redactMu.Lock()
+			defer redactMu.Unlock()
+			return redactValues[v]
+		})
+	}
+	return s
+}
+
+// levelWriter routes the standard log package through logEvent.
+type levelWriter struct {
+	level string
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	logEvent(w.level, nil, strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+var debugLog = log.New(levelWriter{level: "debug"}, "", 0)
+
+func vlog(format string, v ...interface{}) {
+	if verbose {
+		debugLog.Printf(format, v...)
+	}
+}
+
+// logf logs an info line carrying structured fields; text sinks show only
+// the message, JSON sinks add the fields.
+func logf(fields map[string]interface{}, format string, v ...interface{}) {
+	logEvent("info", fields, fmt.Sprintf(format, v...))
+}
+
+func printProgress(done, total int64) {
+	percent := float64(done) / float64(total) * 100
+	logf(map[string]interface{}{"progress_pct": percent, "done": done, "total": total},
+		"Progress: %.1f%% (%d/%d)", percent, done, total)
+}
+
+func apiRequestWithRetry(ctx context.Context, c *PCEClient, method, urlStr string, payload interface{}) ([]byte, error) {
+	data, _, err := apiRequestWithHeaders(ctx, c, method, urlStr, payload)
+	return data, err
+}
+
+// apiRequestWithHeaders is apiRequestWithRetry that also returns the
+// response headers of the successful attempt.
+func apiRequestWithHeaders(ctx context.Context, c *PCEClient, method, urlStr string, payload interface{}) ([]byte, http.Header, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+		vlog("Payload: %s", string(body))
+	}
+
+	var lastErr error
+	retries := retryAttempts
+	for i := 0; i < retries; i++ {
+		delay := backoff(i)
+		req, err := http.NewRequestWithContext(ctx, method, urlStr, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		req.SetBasicAuth(c.User, c.Key)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := httpClient.Do(req)
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		if err != nil {
+			lastErr = err
+		} else {
+			// close before the next attempt so retries don't hold connections
+			data, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			vlog("Response Status: %s", resp.Status)
+			vlog("RAW RESPONSE BODY: %s", string(data))
+
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return data, resp.Header, nil
+			}
+			lastErr = &httpStatusError{StatusCode: resp.StatusCode, Body: string(data)}
+			if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+				// a bad request or bad credentials won't get better on retry
+				return nil, nil, fmt.Errorf("apiRequest failed: %w", lastErr)
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				if ra, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && ra > delay {
+					vlog("Throttled by PCE, waiting %s (Retry-After)", ra)
+					delay = ra
+				}
+			}
+		}
+		if i == retries-1 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+	return nil, nil, fmt.Errorf("apiRequest failed after %d retries: %w", retries, lastErr)
+}
+
+// pageSize is the max_results used when paging through list endpoints.
+var pageSize = 500
+
+// apiGetAll GETs every page of a list endpoint using offset/max_results and
+// returns the combined JSON array. It stops at X-Total-Count or at the first
+// short page when the header is missing.
+func apiGetAll(ctx context.Context, c *PCEClient, urlStr string) ([]byte, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("apiGetAll: %w", err)
+	}
+	var all []json.RawMessage
+	for offset := 0; ; {
+		q := u.Query()
+		q.Set("max_results", strconv.Itoa(pageSize))
+		q.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = q.Encode()
+		data, header, err := apiRequestWithHeaders(ctx, c, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		var page []json.RawMessage
+		if err := json.Unmarshal(data, &page); err != nil {
+			return nil, fmt.Errorf("apiGetAll unmarshal: %w", err)
+		}
+		all = append(all, page...)
+		offset += len(page)
+		total, terr := strconv.Atoi(header.Get("X-Total-Count"))
+		if len(page) == 0 || (terr == nil && offset >= total) || (terr != nil && len(page) < pageSize) {
+			break
+		}
+		vlog("Paging %s: %d of %s", u.Path, offset, header.Get("X-Total-Count"))
+	}
+	if all == nil {
+		all = []json.RawMessage{}
+	}
+	return json.Marshal(all)
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// backoff computes the retry sleep for an attempt; tests may swap in a
+// fixed or zero delay.
+var backoff = backoffDelay
+
+// backoffDelay is the sleep after failed attempt n (0-based): retryBackoffBase
+// doubling up to retryMaxBackoff, with the top retryJitter fraction randomized so
+// concurrent workers don't retry in lockstep.
+func backoffDelay(attempt int) time.Duration {
+	d := retryBackoffBase
+	for i := 0; i < attempt && d < retryMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > retryMaxBackoff {
+		d = retryMaxBackoff
+	}
+	if j := time.Duration(float64(d) * retryJitter); j > 0 {
+		d = d - j + rand.N(j+1)
+	}
+	return d
+}
+
+func getEnvs() ([]Label, error) {
+	return getLabels("env")
+}
+
+// getLabels fetches every label with the given key.
+func getLabels(key string) ([]Label, error) {
+	urlStr := policyPCE.orgURL("/labels", url.Values{"key": {key}})
+	data, err := apiGetAll(context.Background(), policyPCE, urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("getLabels %s: %w", key, err)
+	}
+	var labels []Label
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("getLabels %s unmarshal: %w", key, err)
+	}
+	for _, l := range labels {
+		redactRegister("label", l.Value)
+	}
+	return labels, nil
+}
+
+// hasLabels reports whether the org has any label with the given key,
+// fetching at most one.
+func hasLabels(key string) (bool, error) {
+	urlStr := policyPCE.orgURL("/labels", url.Values{"key": {key}, "max_results": {"1"}})
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+	if err != nil {
+		return false, fmt.Errorf("hasLabels %s: %w", key, err)
+	}
+	var labels []Label
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return false, fmt.Errorf("hasLabels %s unmarshal: %w", key, err)
+	}
+	return len(labels) > 0, nil
+}
+
+// labelExists reports whether a label href still resolves to a live label.
+// Lookups are cached for the rest of the run.
+func labelExists(href string) (bool, error) {
+	labelCacheMu.Lock()
+	exists, ok := labelCache[href]
+	labelCacheMu.Unlock()
+	if ok {
+		return exists, nil
+	}
+
+	urlStr := policyPCE.pceURL(href, nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+	var statusErr *httpStatusError
+	switch {
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound:
+		exists = false
+	case err != nil:
+		return false, fmt.Errorf("labelExists %s: %w", href, err)
+	default:
+		var label struct {
+			Deleted bool `json:"deleted"`
+		}
+		if err := json.Unmarshal(data, &label); err != nil {
+			return false, fmt.Errorf("labelExists unmarshal: %w", err)
+		}
+		exists = !label.Deleted
+	}
+
+	labelCacheMu.Lock()
+	labelCache[href] = exists
+	labelCacheMu.Unlock()
+	return exists, nil
+}
+
+// verifyScopeLabels checks that every label of a query scope still exists,
+// since a stale href makes the PCE report zero flows for an empty scope.
+func verifyScopeLabels(labels []Label) error {
+	var stale []string
+	for _, l := range labels {
+		exists, err := labelExists(l.Href)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			stale = append(stale, fmt.Sprintf("%s=%s (%s)", l.Key, l.Value, l.Href))
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("stale label(s) %s", strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// servicesFile is -services-file: a JSON array of services to analyze
+// instead of the org's ransomware services.
+var servicesFile string
+
+// loadServices returns the services to analyze.
+func loadServices() ([]Service, error) {
+	if servicesFile != "" {
+		return readServicesFile(servicesFile)
+	}
+	return getRansomServices()
+}
+
+// readServicesFile reads a JSON array of Service objects. Other fields, as in
+// an export of the PCE services API, are ignored; missing href/name and bad
+// ports are errors: a curated list shouldn't be silently trimmed.
+func readServicesFile(path string) ([]Service, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("readServicesFile: %w", err)
+	}
+	var services []Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("readServicesFile %s: %w", path, err)
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("readServicesFile %s: no services", path)
+	}
+	seen := make(map[string]bool, len(services))
+	for i, svc := range services {
+		if svc.Href == "" || svc.Name == "" {
+			return nil, fmt.Errorf("readServicesFile %s: service #%d needs both href and name", path, i+1)
+		}
+		if seen[svc.Href] {
+			return nil, fmt.Errorf("readServicesFile %s: duplicate service %s", path, svc.Href)
+		}
+		seen[svc.Href] = true
+		if len(svc.ServicePorts) == 0 {
+			// an empty port list would query, and deny, every service
+			return nil, fmt.Errorf("readServicesFile %s: service %q has no service_ports", path, svc.Name)
+		}
+		if err := validateServicePorts(svc); err != nil {
+			return nil, fmt.Errorf("readServicesFile %s: service %q: %w", path, svc.Name, err)
+		}
+	}
+	return services, nil
+}
+
+func getRansomServices() ([]Service, error) {
+	urlStr := policyPCE.orgURL("/sec_policy/draft/services", url.Values{"is_ransomware": {"true"}})
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getRansomServices: %w", err)
+	}
+	var services []Service
+	if err := json.Unmarshal(data, &services); err != nil {
+		return nil, fmt.Errorf("getRansomServices unmarshal: %w", err)
+	}
+	valid := services[:0]
+	for _, svc := range services {
+		if err := validateServicePorts(svc); err != nil {
+			log.Printf("Warning: skipping service %q (%s): %v", svc.Name, svc.Href, err)
+			continue
+		}
+		valid = append(valid, svc)
+	}
+	return valid, nil
+}
+
+// queryProtos are the protocols a traffic query port entry may name.
+var queryProtos = map[int]string{1: "ICMP", 6: "TCP", 17: "UDP", 58: "ICMPv6"}
+
+// validateServicePorts rejects port entries the async query API would fail
+// on, so a bad service is reported by name rather than mid-query.
+func validateServicePorts(service Service) error {
+	for _, sp := range service.ServicePorts {
+		if _, ok := queryProtos[sp.Proto]; !ok {
+			return fmt.Errorf("unsupported proto %d", sp.Proto)
+		}
+		if sp.Proto != 6 && sp.Proto != 17 {
+			continue
+		}
+		if sp.Port < 1 || sp.Port > 65535 {
+			return fmt.Errorf("%s port %d out of range 1-65535", queryProtos[sp.Proto], sp.Port)
+		}
+		if sp.ToPort != 0 && (sp.ToPort < sp.Port || sp.ToPort > 65535) {
+			return fmt.Errorf("%s port range %d-%d is invalid", queryProtos[sp.Proto], sp.Port, sp.ToPort)
+		}
+	}
+	return nil
+}
+
+func getWorkloadsForEnv(env Label) ([]appScope, error) {
+	query := url.Values{
+		"managed":           {"true"},
+		"online":            {"true"},
+		"labels":            {fmt.Sprintf(`[["%s"]]`, env.Href)},
+		"enforcement_modes": {`["idle","selective","visibility_only"]`},
+	}
+	for k, v := range workloadParams {
+		query[k] = v
+	}
+	urlStr := policyPCE.orgURL("/workloads", query)
+	vlog("Fetching workloads for env %s", env.Value)
+
+	data, err := apiGetAll(context.Background(), policyPCE, urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("getWorkloadsForEnv %s: %w", env.Value, err)
+	}
+
+	var workloads []struct {
+		Hostname string  `json:"hostname"`
+		Labels   []Label `json:"labels"`
+	}
+	if err := json.Unmarshal(data, &workloads); err != nil {
+		return nil, fmt.Errorf("getWorkloadsForEnv unmarshal: %w", err)
+	}
+
+	uniqueApps := make(map[string]appScope)
+	incomplete, filtered, unlabeled, appLabeled := 0, 0, 0, 0
+	for _, w := range workloads {
+		byKey := make(map[string]Label)
+		for _, l := range w.Labels {
+			byKey[l.Key] = l
+		}
+		app, ok := byKey["app"]
+		if ok {
+			appLabeled++
+		}
+		if hostnameFilter != nil && !hostnameFilter.MatchString(w.Hostname) {
+			filtered++
+			continue
+		}
+		if !ok {
+			unlabeled++
+			continue
+		}
+		scope := appScope{app: app}
+		for _, dim := range providerDimensions {
+			if dim == "env" || dim == "app" {
+				continue
+			}
+			l, ok := byKey[dim]
+			if !ok {
+				scope.extras = nil
+				break
+			}
+			scope.extras = append(scope.extras, l)
+		}
+		if len(scope.extras) != len(providerDimensions)-2 {
+			incomplete++
+			continue
+		}
+		uniqueApps[labelsKey(append([]Label{app}, scope.extras...))] = scope
+		redactRegister("label", app.Value)
+		for _, l := range scope.extras {
+			redactRegister("label", l.Value)
+		}
+	}
+	if incomplete > 0 {
+		vlog("Skipped %d workload(s) in env %s missing a label for one of %v",
+			incomplete, env.Value, providerDimensions)
+	}
+	if filtered > 0 {
+		vlog("Skipped %d workload(s) in env %s not matching -hostname-regex", filtered, env.Value)
+	}
+	if unlabeled > 0 {
+		log.Printf("Env %s: %d workload(s) have no app label", env.Value, unlabeled)
+		// an env-wide rule would also cover workloads the filters dropped,
+		// so only an env without any app-labeled workload qualifies
+		switch {
+		case !includeUnlabeled || appLabeled > 0:
+		case len(workloadParams) > 0:
+			log.Printf("Env %s: no app labels among the -workload-param matches; not analyzing the whole env, as workloads outside the filter may have them", env.Value)
+		case hostnameFilter != nil:
+			log.Printf("Env %s: no app labels among the -hostname-regex matches; not analyzing the whole env, as an env-wide rule would also cover non-matching hosts", env.Value)
+		default:
+			log.Printf("Env %s: no app labels at all, analyzing the whole env as one scope (-include-unlabeled)", env.Value)
+			return []appScope{envWideScope()}, nil
+		}
+	}
+	apps := make([]appScope, 0, len(uniqueApps))
+	for _, s := range uniqueApps {
+		apps = append(apps, s)
+	}
+	return apps, nil
+}
+
+// setupEnv does the per-env preparation before any query runs: the env
+// label must still exist and its workloads must be listable.
+func setupEnv(env Label) ([]appScope, error) {
+	exists, err := labelExists(env.Href)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("env label %s no longer exists", env.Href)
+	}
+	return getWorkloadsForEnv(env)
+}
+
+type envSetup struct {
+	apps []appScope
+	err  error
+}
+
+// setupEnvs runs setupEnv for all envs with at most workers in flight.
+// Results keep the order of envs.
+func setupEnvs(envs []Label, workers int) []envSetup {
+	results := make([]envSetup, len(envs))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	for i, env := range envs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, env Label) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			apps, err := setupEnv(env)
+			results[i] = envSetup{apps: apps, err: err}
+		}(i, env)
+	}
+	wg.Wait()
+	return results
+}
+
+// scopeLabels returns the full label set for an env/app scope in
+// --provider-dimensions order.
+func scopeLabels(env Label, scope appScope) []Label {
+	if scope.envWide() {
+		return []Label{env}
+	}
+	return append([]Label{env, scope.app}, scope.extras...)
+}
+
+// envWideScope stands in for the apps of an env without app labels; its
+// app has no href and only names the scope in logs and reports.
+func envWideScope() appScope {
+	return appScope{app: Label{Key: "app", Value: "(whole env)"}}
+}
+
+func (s appScope) envWide() bool {
+	return s.app.Href == ""
+}
+
+func labelsKey(labels []Label) string {
+	return strings.Join(hrefsOf(labels), ",")
+}
+
+func labelRefs(labels []Label) []map[string]map[string]string {
+	refs := make([]map[string]map[string]string, 0, len(labels))
+	for _, l := range labels {
+		refs = append(refs, map[string]map[string]string{
+			"label": {"href": l.Href},
+		})
+	}
+	return refs
+}
+
+// checkScopeDimensions makes sure a query scope or rule provider set covers
+// exactly the --provider-dimensions keys, so what we analyze is what we deny.
+func checkScopeDimensions(labels []Label) error {
+	if len(labels) == 1 && labels[0].Key == "env" {
+		// an -include-unlabeled env-wide scope
+		return nil
+	}
+	seen := make(map[string]bool)
+	for _, l := range labels {
+		if !containsString(providerDimensions, l.Key) {
+			return fmt.Errorf("label %q (key %s) is outside provider dimensions %v",
+				l.Value, l.Key, providerDimensions)
+		}
+		seen[l.Key] = true
+	}
+	for _, dim := range providerDimensions {
+		if !seen[dim] {
+			return fmt.Errorf("scope has no %s label (provider dimensions %v)", dim, providerDimensions)
+		}
+	}
+	return nil
+}
+
+// parseDecisions validates a comma-separated decision list against the
+// values the PCE accepts.
+func parseDecisions(s string, allowed []string) ([]string, error) {
+	decisions := []string{}
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" || containsString(decisions, d) {
+			continue
+		}
+		if !containsString(allowed, d) {
+			return nil, fmt.Errorf("unknown decision %q (allowed: %s)", d, strings.Join(allowed, ", "))
+		}
+		decisions = append(decisions, d)
+	}
+	return decisions, nil
+}
+
+// localAddr binds an address to localhost unless a host was given
+// explicitly, so debug endpoints are not exposed by accident.
+func localAddr(addr string) string {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return net.JoinHostPort("127.0.0.1", addr)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, p)
+}
+
+// metric is one value served on -metrics-addr.
+type metric struct {
+	name, help, kind string
+	value            func() int64
+}
+
+// metricsMux serves metrics at /metrics in the Prometheus text format.
+func metricsMux(metrics []metric) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range metrics {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value())
+		}
+	})
+	return mux
+}
+
+// parseWorkloadParams turns key=value pairs into extra workloads query
+// parameters.
+func parseWorkloadParams(pairs []string) (url.Values, error) {
+	params := url.Values{}
+	for _, pair := range pairs {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		if containsString(reservedWorkloadParams, k) {
+			return nil, fmt.Errorf("%q is set by the tool and cannot be overridden", k)
+		}
+		params.Add(k, strings.TrimSpace(v))
+	}
+	return params, nil
+}
+
+func parseResolveLabelsAs(s string) ([]string, error) {
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" || containsString(values, v) {
+			continue
+		}
+		if !containsString(allowedResolveLabelsAs, v) {
+			return nil, fmt.Errorf("unknown value %q (allowed: %s)", v, strings.Join(allowedResolveLabelsAs, ", "))
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func parseWorkloadSubnets(s string) ([]string, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "providers", "consumers":
+		return []string{s}, nil
+	case "both":
+		return []string{"providers", "consumers"}, nil
+	}
+	return nil, fmt.Errorf("unknown value %q (allowed: providers, consumers, both)", s)
+}
+
+func parseProviderDimensions(s string) ([]string, error) {
+	dims := []string{"env", "app"}
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "" || d == "env" || d == "app" || containsString(dims, d) {
+			continue
+		}
+		if !containsString(optionalDimensions, d) {
+			return nil, fmt.Errorf("unknown provider dimension %q (allowed: env, app, %s)",
+				d, strings.Join(optionalDimensions, ", "))
+		}
+		dims = append(dims, d)
+	}
+	return dims, nil
+}
+
+// parseScopeBy turns the deprecated -scope-by (e.g. "env,loc") into
+// provider dimensions. env is required; app is always part of the scope.
+func parseScopeBy(s string) ([]string, error) {
+	var rest []string
+	hasEnv := false
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "env" {
+			hasEnv = true
+			continue
+		}
+		rest = append(rest, d)
+	}
+	if !hasEnv {
+		return nil, fmt.Errorf("%q must include env", s)
+	}
+	return parseProviderDimensions(strings.Join(append([]string{"env", "app"}, rest...), ","))
+}
+
+// stringList is a repeatable flag that also accepts comma-separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// repeatedList is a repeatable flag taking each value whole, for values
+// that may themselves contain commas.
+type repeatedList []string
+
+func (l *repeatedList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *repeatedList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// filterEnvs keeps the env labels whose value matches one of values,
+// ignoring case. Naming an env that doesn't exist is an error.
+func filterEnvs(envs []Label, values []string) ([]Label, error) {
+	var kept []Label
+	var missing []string
+	for _, v := range values {
+		found := false
+		for _, e := range envs {
+			if strings.EqualFold(e.Value, v) {
+				found = true
+				if !containsString(hrefsOf(kept), e.Href) {
+					kept = append(kept, e)
+				}
+			}
+		}
+		if !found {
+			missing = append(missing, v)
+		}
+	}
+	if len(missing) > 0 {
+		available := labelValues(envs)
+		sort.Strings(available)
+		return nil, fmt.Errorf("no env %s (available: %s)",
+			strings.Join(missing, ", "), strings.Join(available, ", "))
+	}
+	return kept, nil
+}
+
+// filterApps keeps the app scopes whose app value matches one of values,
+// ignoring case, and returns the values no scope matched.
+func filterApps(apps []appScope, values []string) ([]appScope, []string) {
+	var kept []appScope
+	matched := make(map[string]bool)
+	for _, a := range apps {
+		for _, v := range values {
+			if strings.EqualFold(a.app.Value, v) {
+				kept = append(kept, a)
+				matched[v] = true
+				break
+			}
+		}
+	}
+	var missing []string
+	for _, v := range values {
+		if !matched[v] {
+			missing = append(missing, v)
+		}
+	}
+	return kept, missing
+}
+
+// filterServices keeps the services named in names. A name outside the
+// ransomware set is an error.
+func filterServices(services []Service, names []string) ([]Service, error) {
+	byName := make(map[string]Service, len(services))
+	valid := make([]string, 0, len(services))
+	for _, s := range services {
+		byName[s.Name] = s
+		valid = append(valid, s.Name)
+	}
+	var kept []Service
+	var missing []string
+	for _, n := range names {
+		s, ok := byName[n]
+		if !ok {
+			missing = append(missing, n)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if len(missing) > 0 {
+		sort.Strings(valid)
+		return nil, fmt.Errorf("unknown service: %s (valid: %s)",
+			strings.Join(missing, ", "), strings.Join(valid, ", "))
+	}
+	return kept, nil
+}
+
+// pinEnvs keeps only the env labels whose href was pinned with -env-href,
+// which resolves duplicate env values deterministically.
+func pinEnvs(envs []Label, hrefs []string) ([]Label, error) {
+	byHref := make(map[string]Label, len(envs))
+	for _, e := range envs {
+		byHref[e.Href] = e
+	}
+	pinned := make([]Label, 0, len(hrefs))
+	var missing []string
+	for _, h := range hrefs {
+		e, ok := byHref[h]
+		if !ok {
+			missing = append(missing, h)
+			continue
+		}
+		if !containsString(hrefsOf(pinned), h) {
+			pinned = append(pinned, e)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("no env label with href %s", strings.Join(missing, ", "))
+	}
+	return pinned, nil
+}
+
+func labelValues(labels []Label) []string {
+	values := make([]string, 0, len(labels))
+	for _, l := range labels {
+		values = append(values, l.Value)
+	}
+	return values
+}
+
+func hrefsOf(labels []Label) []string {
+	hrefs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		hrefs = append(hrefs, l.Href)
+	}
+	return hrefs
+}
+
+// splitRule breaks a rule into chunks of at most max apps, sorted so the
+// split is the same on every run. max <= 0 means no cap.
+func splitRule(dr denyRuleInfo, max int) []denyRuleInfo {
+	if max <= 0 || len(dr.apps) <= max {
+		return []denyRuleInfo{dr}
+	}
+	apps := append([]Label(nil), dr.apps...)
+	sort.Slice(apps, func(i, j int) bool {
+		if apps[i].Value != apps[j].Value {
+			return apps[i].Value < apps[j].Value
+		}
+		return apps[i].Href < apps[j].Href
+	})
+	parts := (len(apps) + max - 1) / max
+	rules := make([]denyRuleInfo, 0, parts)
+	for i := 0; i < parts; i++ {
+		end := (i + 1) * max
+		if end > len(apps) {
+			end = len(apps)
+		}
+		part := dr
+		part.apps = apps[i*max : end]
+		part.part, part.parts = i+1, parts
+		rules = append(rules, part)
+	}
+	return rules
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// groupByExtras splits the no-traffic scopes of one (env, service) into rules
+// that share the same extra labels, so a rule never crosses e.g. app1 with a
+// loc that was only analyzed for app2.
+func groupByExtras(env Label, service Service, scopes []appScope) []denyRuleInfo {
+	groups := make(map[string]*denyRuleInfo)
+	var keys []string
+	for _, s := range scopes {
+		k := labelsKey(s.extras)
+		dr, ok := groups[k]
+		if !ok {
+			dr = &denyRuleInfo{env: env, service: service, extras: s.extras}
+			groups[k] = dr
+			keys = append(keys, k)
+		}
+		dr.apps = append(dr.apps, s.app)
+	}
+	sort.Strings(keys)
+	rules := make([]denyRuleInfo, 0, len(keys))
+	for _, k := range keys {
+		rules = append(rules, *groups[k])
+	}
+	return rules
+}
+
+// trafficQueryPayloads builds the short- and long-window async query
+// payloads for one env/app/service combination.
+func trafficQueryPayloads(
+	env Label, scope appScope,
+	service Service,
+	excludeBroadcast, excludeMulticast bool,
+) (map[string]interface{}, map[string]interface{}, error) {
+	labels := scopeLabels(env, scope)
+	if err := checkScopeDimensions(labels); err != nil {
+		return nil, nil, fmt.Errorf("query scope: %w", err)
+	}
+
+	now := time.Now().UTC()
+	startShort := now.Add(-shortWindow).Format(time.RFC3339)
+	startLong := now.Add(-longWindow).Format(time.RFC3339)
+	end := now.Format(time.RFC3339)
+
+	ports := servicePortsPayload(service)
+	name := func(window time.Duration) string {
+		return queryName("Query Env: %s App: %s Service: %s (%s)", env.Href, scope.app.Href, service.Name, formatWindow(window))
+	}
+	return buildTrafficQuery(labels, ports, startShort, end, name(shortWindow), excludeBroadcast, excludeMulticast),
+		buildTrafficQuery(labels, ports, startLong, end, name(longWindow), excludeBroadcast, excludeMulticast),
+		nil
+}
+
+// maxQueryNameLen is the PCE's limit on an async query's query_name.
+const maxQueryNameLen = 255
+
+var querySeq int64
+
+// queryName formats an async query_name and appends a run-unique suffix,
+// so concurrent queries are told apart in the PCE's query list. The
+// description is cut to keep the name within maxQueryNameLen.
+func queryName(format string, args ...interface{}) string {
+	suffix := fmt.Sprintf(" [%s #%d]", runID, atomic.AddInt64(&querySeq, 1))
+	desc := fmt.Sprintf(format, args...)
+	if len(desc)+len(suffix) > maxQueryNameLen {
+		// cut on a rune boundary so a label value never ends in half a rune
+		n := maxQueryNameLen - len(suffix)
+		for n > 0 && !utf8.RuneStart(desc[n]) {
+			n--
+		}
+		desc = desc[:n]
+	}
+	return desc + suffix
+}
+
+// windowResult is the flow count one lookback window query reported.
+type windowResult struct {
+	Window string `json:"window"`
+	// Direction is set when -direction queries more than inbound flows
+	Direction string `json:"direction,omitempty"`
+	Start     string `json:"start"`
+	End       string `json:"end"`
+	Flows     int64  `json:"flows"`
+
+	// Samples holds up to -sample-flows downloaded flow records
+	Samples []flowRecord `json:"sample_flows,omitempty"`
+}
+
+func newWindowResult(window time.Duration, query map[string]interface{}, flows int64) windowResult {
+	start, _ := query["start_date"].(string)
+	end, _ := query["end_date"].(string)
+	return windowResult{Window: formatWindow(window), Start: start, End: end, Flows: flows}
+}
+
+// singleWindow is -single-window: query only the long window instead of
+// the short window first.
+var singleWindow bool
+
+// lookbackWindows returns the windows queried, in order.
+func lookbackWindows() []time.Duration {
+	if singleWindow {
+		return []time.Duration{longWindow}
+	}
+	return []time.Duration{shortWindow, longWindow}
+}
+
+// describeWindows summarizes the lookback for logs and reports.
+func describeWindows() string {
+	if singleWindow {
+		return fmt.Sprintf("zero flows in the last %s", formatWindow(longWindow))
+	}
+	return fmt.Sprintf("zero flows in the last %s and the last %s", formatWindow(shortWindow), formatWindow(longWindow))
+}
+
+// formatWindow prints whole days as "89d" instead of "2136h0m0s".
+func formatWindow(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	return d.String()
+}
+
+// plannedQuery is one async query payload of a combination: a lookback
+// window in one -direction.
+type plannedQuery struct {
+	direction string // empty unless -direction covers more than ingress
+	window    time.Duration
+	query     map[string]interface{}
+}
+
+// plannedQueries lists the payloads submitTrafficQuery sends for a
+// combination, in order: per -direction, the short window (unless
+// -single-window) then the long one. -describe-query and -save-queries use
+// it too, so they show exactly what is submitted.
+func plannedQueries(
+	env Label, scope appScope,
+	service Service,
+	excludeBroadcast, excludeMulticast bool,
+) ([]plannedQuery, error) {
+	var planned []plannedQuery
+	for _, egress := range egressDirections() {
+		shortQuery, longQuery, err := trafficQueryPayloads(env, scope, service, excludeBroadcast, excludeMulticast)
+		if err != nil {
+			return nil, err
+		}
+		direction := ""
+		if ruleDirection != "ingress" {
+			direction = "ingress"
+		}
+		if egress {
+			shortQuery, longQuery, direction = egressQuery(shortQuery), egressQuery(longQuery), "egress"
+		}
+		if !singleWindow {
+			planned = append(planned, plannedQuery{direction, shortWindow, shortQuery})
+		}
+		planned = append(planned, plannedQuery{direction, longWindow, longQuery})
+	}
+	return planned, nil
+}
+
+// key names the query in -describe-query output: short_window or
+// long_window, prefixed by the direction when there is one.
+func (q plannedQuery) key() string {
+	key := "long_window"
+	if q.window == shortWindow {
+		key = "short_window"
+	}
+	if q.direction != "" {
+		key = q.direction + "_" + key
+	}
+	return key
+}
+
+func submitTrafficQuery(
+	ctx context.Context,
+	env Label, scope appScope,
+	service Service,
+	excludeBroadcast, excludeMulticast bool,
+) (bool, []windowResult, error) {
+	planned, err := plannedQueries(env, scope, service, excludeBroadcast, excludeMulticast)
+	if err != nil {
+		return false, nil, err
+	}
+	url := asyncQueriesURL()
+	ports := len(service.ServicePorts)
+	var windows []windowResult
+	for _, q := range planned {
+		// a later window or direction is only reached while all before
+		// it had no traffic
+		wr, err := runWindowQuery(ctx, url, q.query, q.window, ports)
+		if err != nil {
+			return false, windows, err
+		}
+		wr.Direction = q.direction
+		windows = append(windows, wr)
+		if wr.Flows > 0 {
+			return false, windows, nil
+		}
+	}
+
+	// every window queried reported zero flows → safe to deny
+	return true, windows, nil
+}
+
+// egressQuery turns an ingress traffic query into one for flows the scope
+// sends: the destination scope becomes the source and any destination
+// counts. Source exclusions only make sense inbound and are dropped.
+func egressQuery(query map[string]interface{}) map[string]interface{} {
+	dst := query["destinations"].(map[string]interface{})
+	query["sources"] = map[string]interface{}{
+		"include": dst["include"],
+		"exclude": []interface{}{},
+	}
+	query["destinations"] = map[string]interface{}{
+		"include": []interface{}{[]interface{}{}},
+		"exclude": dst["exclude"],
+	}
+	return query
+}
+
+// sampleFlows is -sample-flows: how many flow records to download per
+// window that saw traffic. 0 keeps to the count-only path.
+var sampleFlows int
+
+// runWindowQuery runs one lookback window query and, with -sample-flows,
+// downloads up to that many of its flows for auditing.
+func runWindowQuery(ctx context.Context, url string, query map[string]interface{}, window time.Duration, ports int) (windowResult, error) {
+	if sampleFlows > 0 {
+		query["max_results"] = sampleFlows
+	}
+	href, flows, err := runAsyncQuery(ctx, url, query, queryTimeout(ports, window))
+	if err != nil {
+		return windowResult{}, err
+	}
+	wr := newWindowResult(window, query, flows)
+	if flows > 0 && sampleFlows > 0 {
+		// the verdict stands without samples, so a failed download only warns
+		samples, err := downloadFlows(ctx, href)
+		if err != nil {
+			log.Printf("Failed to download sample flows of %s: %v", href, err)
+		} else {
+			if len(samples) > sampleFlows {
+				samples = samples[:sampleFlows]
+			}
+			wr.Samples = samples
+		}
+	}
+	return wr, nil
+}
+
+// batchMaxResults caps the flows a -query-mode per-service query returns.
+// Reaching it means flows may be missing, so no app can be called quiet.
+const batchMaxResults = 100000
+
+var errRunTimeout = errors.New("-run-timeout reached")
+
+var errBatchTruncated = errors.New("per-service query hit max_results, results may be truncated")
+
+// errBatchUnattributed means some flows of a per-service query couldn't be
+// tied to an app scope, so quiet-looking apps may not be quiet.
+var errBatchUnattributed = errors.New("per-service query returned flows not attributable to an app")
+
+// flowEndpoint is one side of a downloaded flow record.
+type flowEndpoint struct {
+	IP       string `json:"ip"`
+	Workload *struct {
+		Href     string  `json:"href"`
+		Hostname string  `json:"hostname"`
+		Labels   []Label `json:"labels"`
+	} `json:"workload,omitempty"`
+}
+
+// flowRecord is one row of a downloaded async query result.
+type flowRecord struct {
+	Src     flowEndpoint `json:"src"`
+	Dst     flowEndpoint `json:"dst"`
+	Service struct {
+		Port  int `json:"port"`
+		Proto int `json:"proto"`
+	} `json:"service"`
+	NumConnections int64  `json:"num_connections"`
+	PolicyDecision string `json:"policy_decision,omitempty"`
+}
+
+// downloadFlows fetches the flow records of a completed async query.
+func downloadFlows(ctx context.Context, queryHref string) ([]flowRecord, error) {
+	urlStr := queryPCE.pceURL(queryHref+"/download", nil)
+	data, err := apiRequestWithRetry(ctx, queryPCE, "GET", urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("downloadFlows: %w", err)
+	}
+	var flows []flowRecord
+	if err := json.Unmarshal(data, &flows); err != nil {
+		return nil, fmt.Errorf("downloadFlows unmarshal: %w", err)
+	}
+	return flows, nil
+}
+
+// appQueryResult is the two-window verdict for one app scope.
+type appQueryResult struct {
+	ok      bool
+	windows []windowResult
+}
+
+// submitServiceQuery is submitTrafficQuery for all app scopes of an env at
+// once: one async query per window with a destination include row per
+// scope, whose downloaded flows are attributed back to the scopes. Results
+// are keyed by labelsKey(scopeLabels(env, scope)).
+func submitServiceQuery(
+	ctx context.Context,
+	env Label, scopes []appScope,
+	service Service,
+	excludeBroadcast, excludeMulticast bool,
+) (map[string]appQueryResult, error) {
+	results := make(map[string]appQueryResult, len(scopes))
+	pending := scopes
+	now := time.Now().UTC()
+	end := now.Format(time.RFC3339)
+	ports := servicePortsPayload(service)
+	for _, window := range lookbackWindows() {
+		if len(pending) == 0 {
+			break
+		}
+		var include [][]map[string]map[string]string
+		for _, s := range pending {
+			labels := scopeLabels(env, s)
+			if err := checkScopeDimensions(labels); err != nil {
+				return nil, fmt.Errorf("query scope: %w", err)
+			}
+			include = append(include, labelRefs(labels))
+		}
+		name := queryName("Query Env: %s Service: %s (%s)", env.Href, service.Name, formatWindow(window))
+		query := buildTrafficQuery(nil, ports, now.Add(-window).Format(time.RFC3339), end, name, excludeBroadcast, excludeMulticast)
+		query["destinations"].(map[string]interface{})["include"] = include
+		query["max_results"] = batchMaxResults
+
+		href, flows, err := runAsyncQuery(ctx, asyncQueriesURL(), query, queryTimeout(len(service.ServicePorts), window))
+		if err != nil {
+			return nil, err
+		}
+		if flows >= batchMaxResults {
+			return nil, errBatchTruncated
+		}
+		counts := make(map[string]int64)
+		samples := make(map[string][]flowRecord)
+		if flows > 0 {
+			records, err := downloadFlows(ctx, href)
+			if err != nil {
+				return nil, err
+			}
+			if int64(len(records)) < flows {
+				return nil, fmt.Errorf("%w: downloaded %d of %d flows", errBatchUnattributed, len(records), flows)
+			}
+			unattributed := 0
+			for _, f := range records {
+				if f.Dst.Workload == nil {
+					unattributed++
+					continue
+				}
+				have := make(map[string]bool, len(f.Dst.Workload.Labels))
+				for _, l := range f.Dst.Workload.Labels {
+					have[l.Href] = true
+				}
+				attributed := false
+				for _, s := range pending {
+					labels := scopeLabels(env, s)
+					matched := true
+					for _, l := range labels {
+						matched = matched && have[l.Href]
+					}
+					if matched {
+						attributed = true
+						key := labelsKey(labels)
+						counts[key]++
+						if len(samples[key]) < sampleFlows {
+							samples[key] = append(samples[key], f)
+						}
+					}
+				}
+				if !attributed {
+					unattributed++
+				}
+			}
+			if unattributed > 0 {
+				return nil, fmt.Errorf("%w: %d of %d flows", errBatchUnattributed, unattributed, len(records))
+			}
+		}
+
+		var quiet []appScope
+		for _, s := range pending {
+			key := labelsKey(scopeLabels(env, s))
+			r := results[key]
+			wr := newWindowResult(window, query, counts[key])
+			wr.Samples = samples[key]
+			r.windows = append(r.windows, wr)
+			results[key] = r
+			if counts[key] == 0 {
+				quiet = append(quiet, s)
+			}
+		}
+		pending = quiet
+	}
+	// zero flows in both windows → safe to deny
+	for _, s := range pending {
+		key := labelsKey(scopeLabels(env, s))
+		r := results[key]
+		r.ok = true
+		results[key] = r
+	}
+	return results, nil
+}
+
+// cacheEntry is one finished query verdict in the -cache file.
+type cacheEntry struct {
+	Key       string         `json:"key"`
+	NoTraffic bool           `json:"no_traffic"`
+	Windows   []windowResult `json:"windows"`
+	Time      time.Time      `json:"time"`
+}
+
+// resultCache persists finished verdicts as they complete, one JSON object
+// per line, so a resumed run only queries what is still unanswered. A nil
+// cache is disabled.
+type resultCache struct {
+	mu      sync.Mutex
+	f       *os.File
+	entries map[string]cacheEntry
+}
+
+// cacheKey identifies a query by hrefs, so renamed labels still match, and
+// by the querySettingsKey of the run, so results from runs with other
+// settings don't.
+func cacheKey(env Label, scope appScope, service Service, settings string) string {
+	return labelsKey(scopeLabels(env, scope)) + "|" + service.Href + "|" + settings
+}
+
+// querySettingsKey hashes every setting that shapes a traffic query or how
+// its result is read, so a verdict from narrower filters is never reused.
+func querySettingsKey(service Service, excludeBroadcast, excludeMulticast bool) string {
+	sorted := func(v []string) []string {
+		v = append([]string(nil), v...)
+		sort.Strings(v)
+		return v
+	}
+	settings, _ := json.Marshal(map[string]interface{}{
+		"windows":              lookbackWindows(),
+		"direction":            ruleDirection,
+		"ports":                service.ServicePorts,
+		"policy_decisions":     sorted(policyDecisions),
+		"boundary_decisions":   sorted(boundaryDecisions),
+		"exclude_ip_lists":     sorted(excludedSourceIPLists),
+		"exclude_cidrs":        sorted(excludedSourceCIDRs),
+		"exclude_broadcast":    excludeBroadcast,
+		"exclude_multicast":    excludeMulticast,
+		"resolve_sources":      resolveSourcesAs,
+		"resolve_destinations": resolveDestinationsAs,
+	})
+	sum := sha256.Sum256(settings)
+	return hex.EncodeToString(sum[:8])
+}
+
+// openResultCache loads the verdicts of earlier runs, dropping those older
+// than maxAge (0 keeps all), since traffic seen since then is unknown.
+func openResultCache(path string, maxAge time.Duration) (*resultCache, error) {
+	c := &resultCache{entries: make(map[string]cacheEntry)}
+	var expired int
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("openResultCache: %w", err)
+	}
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var e cacheEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			// most likely a line cut short when the last run died
+			log.Printf("Ignoring unreadable -cache line %d: %v", i+1, err)
+			continue
+		}
+		if maxAge > 0 && time.Since(e.Time) > maxAge {
+			expired++
+			continue
+		}
+		c.entries[e.Key] = e
+	}
+	if expired > 0 {
+		log.Printf("Ignoring %d -cache result(s) older than %s", expired, maxAge)
+	}
+	if c.f, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("openResultCache: %w", err)
+	}
+	return c, nil
+}
+
+func (c *resultCache) get(key string) (cacheEntry, bool) {
+	if c == nil {
+		return cacheEntry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	return e, ok
+}
+
+func (c *resultCache) put(e cacheEntry) error {
+	if c == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[e.Key] = e
+	_, err = c.f.Write(append(data, '\n'))
+	return err
+}
+
+func (c *resultCache) Close() error {
+	if c == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+// describeQuery prints the exact async query payloads for one env/app/service
+// combination, resolved by value/name, without submitting anything.
+func describeQuery(envValue, appValue, serviceName string, excludeBroadcast, excludeMulticast bool) error {
+	if envValue == "" || appValue == "" || serviceName == "" {
+		return fmt.Errorf("-describe-query needs -env, -app and -service")
+	}
+	envs, err := getEnvs()
+	if err != nil {
+		return err
+	}
+	var env *Label
+	for i := range envs {
+		if strings.EqualFold(envs[i].Value, envValue) {
+			env = &envs[i]
+			break
+		}
+	}
+	if env == nil {
+		return fmt.Errorf("no env label with value %q", envValue)
+	}
+	services, err := loadServices()
+	if err != nil {
+		return err
+	}
+	var service *Service
+	for i := range services {
+		if strings.EqualFold(services[i].Name, serviceName) {
+			service = &services[i]
+			break
+		}
+	}
+	if service == nil {
+		return fmt.Errorf("no service named %q", serviceName)
+	}
+	scopes, err := getWorkloadsForEnv(*env)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, scope := range scopes {
+		if !strings.EqualFold(scope.app.Value, appValue) {
+			continue
+		}
+		found = true
+		planned, err := plannedQueries(*env, scope, *service, excludeBroadcast, excludeMulticast)
+		if err != nil {
+			return err
+		}
+		queries := map[string]interface{}{
+			"scope": describeLabels(scopeLabels(*env, scope)),
+			"url":   asyncQueriesURL(),
+		}
+		for _, q := range planned {
+			queries[q.key()] = q.query
+		}
+		data, err := json.MarshalIndent(queries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	if !found {
+		return fmt.Errorf("no app %q with workloads in env %s", appValue, env.Value)
+	}
+	return nil
+}
+
+// savedQueriesPath is the org-relative collection explorer saved queries
+// live under.
+const savedQueriesPath = "/traffic_flows/saved_queries"
+
+var (
+	savedQueriesMu sync.Mutex
+	savedQueries   []string
+)
+
+// saveQueries stores the planned payloads of a combination as named explorer
+// queries tagged with the run ID, so analysts can reopen them later.
+func saveQueries(env Label, scope appScope, service Service, excludeBroadcast, excludeMulticast bool) error {
+	planned, err := plannedQueries(env, scope, service, excludeBroadcast, excludeMulticast)
+	if err != nil {
+		return err
+	}
+	urlStr := queryPCE.orgURL(savedQueriesPath, nil)
+	for _, q := range planned {
+		label := formatWindow(q.window)
+		if q.direction != "" {
+			label += " " + q.direction
+		}
+		q.query["query_name"] = fmt.Sprintf("auto-deny-rules %s Env:%s App:%s Service:%s (%s)",
+			runID, env.Value, scope.app.Value, service.Name, label)
+		data, err := apiRequestWithRetry(context.Background(), queryPCE, "POST", urlStr, q.query)
+		if err != nil {
+			return fmt.Errorf("saveQueries: %w", err)
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return fmt.Errorf("saveQueries unmarshal: %w", err)
+		}
+		if href, _ := resp["href"].(string); href != "" {
+			savedQueriesMu.Lock()
+			savedQueries = append(savedQueries, href)
+			savedQueriesMu.Unlock()
+		}
+	}
+	return nil
+}
+
+func deleteSavedQueries() {
+	savedQueriesMu.Lock()
+	hrefs := savedQueries
+	savedQueries = nil
+	savedQueriesMu.Unlock()
+	deleted := 0
+	for _, href := range hrefs {
+		urlStr := queryPCE.pceURL(href, nil)
+		if _, err := apiRequestWithRetry(context.Background(), queryPCE, "DELETE", urlStr, nil); err != nil {
+			log.Printf("Failed to delete saved query %s: %v", href, err)
+			continue
+		}
+		deleted++
+	}
+	log.Printf("Deleted %d of %d saved queries for run %s", deleted, len(hrefs), runID)
+}
+
+func asyncQueriesURL() string {
+	return queryPCE.orgURL("/traffic_flows/async_queries", nil)
+}
+
+func servicePortsPayload(service Service) []map[string]interface{} {
+	var ports []map[string]interface{}
+	for _, sp := range service.ServicePorts {
+		p := map[string]interface{}{
+			"port":  sp.Port,
+			"proto": sp.Proto,
+		}
+		if sp.ToPort != 0 {
+			p["to_port"] = sp.ToPort
+		}
+		ports = append(ports, p)
+	}
+	return ports
+}
+
+// buildTrafficQuery builds an async query payload for flows into the given
+// destination scope. Empty ports means any service.
+func buildTrafficQuery(
+	labels []Label,
+	ports []map[string]interface{},
+	start, end, name string,
+	excludeBroadcast, excludeMulticast bool,
+) map[string]interface{} {
+	if ports == nil {
+		ports = []map[string]interface{}{}
+	}
+	query := map[string]interface{}{
+		"sources": map[string]interface{}{
+			"include": []interface{}{[]interface{}{}},
+			"exclude": buildSourceExclusions(excludedSourceIPLists, excludedSourceCIDRs),
+		},
+		"destinations": map[string]interface{}{
+			"include": [][]map[string]map[string]string{
+				labelRefs(labels),
+			},
+			"exclude": buildDestExclusions(excludeBroadcast, excludeMulticast),
+		},
+		"services": map[string]interface{}{
+			"include": ports,
+			"exclude": []interface{}{},
+		},
+		"sources_destinations_query_op":        "and",
+		"start_date":                           start,
+		"end_date":                             end,
+		"policy_decisions":                     policyDecisions,
+		"boundary_decisions":                   boundaryDecisions,
+		"query_name":                           name,
+		"exclude_workloads_from_ip_list_query": true,
+		"max_results":                          1,
+	}
+	if len(resolveSourcesAs) > 0 || len(resolveDestinationsAs) > 0 {
+		resolve := map[string][]string{}
+		if len(resolveSourcesAs) > 0 {
+			resolve["source"] = resolveSourcesAs
+		}
+		if len(resolveDestinationsAs) > 0 {
+			resolve["destination"] = resolveDestinationsAs
+		}
+		query["resolve_labels_as"] = resolve
+	}
+	return query
+}
+
+type baselineResult struct {
+	once       sync.Once
+	hasTraffic bool
+	err        error
+}
+
+var (
+	baselineMu    sync.Mutex
+	baselineCache = make(map[string]*baselineResult)
+)
+
+// hasBaselineTraffic reports whether the scope saw any flow at all over the
+// long window, proving its workloads report traffic. Each scope is queried
+// once per run, however many services are analyzed for it.
+func hasBaselineTraffic(ctx context.Context, env Label, scope appScope, excludeBroadcast, excludeMulticast bool) (bool, error) {
+	labels := scopeLabels(env, scope)
+	baselineMu.Lock()
+	r, ok := baselineCache[labelsKey(labels)]
+	if !ok {
+		r = &baselineResult{}
+		baselineCache[labelsKey(labels)] = r
+	}
+	baselineMu.Unlock()
+
+	r.once.Do(func() {
+		now := time.Now().UTC()
+		name := queryName("Baseline Env: %s App: %s", env.Href, scope.app.Href)
+		payload := buildTrafficQuery(labels, nil,
+			now.Add(-longWindow).Format(time.RFC3339), now.Format(time.RFC3339),
+			name, excludeBroadcast, excludeMulticast)
+		flows, err := runSingleAsyncQuery(ctx, asyncQueriesURL(), payload, queryTimeout(0, longWindow))
+		r.hasTraffic, r.err = flows > 0, err
+	})
+	return r.hasTraffic, r.err
+}
+
+// latencyThrottle spaces out new async query submissions while the rolling
+// average query duration is above the -throttle-on-latency threshold.
+type latencyThrottle struct {
+	mu        sync.Mutex
+	threshold time.Duration
+	samples   []time.Duration
+	next      int
+	engaged   bool
+}
+
+const latencyWindow = 10
+
+var queryThrottle = &latencyThrottle{}
+
+func (t *latencyThrottle) average() time.Duration {
+	if len(t.samples) == 0 {
+		return 0
+	}
+	var sum time.Duration
+	for _, d := range t.samples {
+		sum += d
+	}
+	return sum / time.Duration(len(t.samples))
+}
+
+func (t *latencyThrottle) observe(d time.Duration) {
+	if t.threshold <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+	} else {
+		t.samples[t.next] = d
+		t.next = (t.next + 1) % latencyWindow
+	}
+	avg := t.average()
+	if avg > t.threshold && !t.engaged {
+		t.engaged = true
+		log.Printf("Throttling engaged: average query latency %s exceeds %s", avg.Round(time.Second), t.threshold)
+	} else if avg <= t.threshold && t.engaged {
+		t.engaged = false
+		log.Printf("Throttling disengaged: average query latency back to %s", avg.Round(time.Second))
+	}
+}
+
+// wait delays a new submission by the current average latency while the
+// throttle is engaged, roughly serializing the worker pool until it recovers.
+// It gives up early with ctx's error.
+func (t *latencyThrottle) wait(ctx context.Context) error {
+	t.mu.Lock()
+	engaged, avg := t.engaged, t.average()
+	t.mu.Unlock()
+	if !engaged {
+		return nil
+	}
+	vlog("Throttled: delaying query submission by %s", avg.Round(time.Second))
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(avg):
+		return nil
+	}
+}
+
+// -poll-interval spaces the status GETs of an async query; -poll-timeout (or
+// the adaptive bounds) caps the whole query. Each GET is separately bounded
+// by -http-timeout.
+var (
+	pollInterval        = 5 * time.Second
+	defaultPollTimeout  = 5 * time.Minute
+	adaptivePollTimeout bool
+	pollTimeoutMin      = time.Minute
+	pollTimeoutMax      = 15 * time.Minute
+)
+
+// pollTimeoutPerPortDay is how much poll time each service port adds per
+// day of lookback under -adaptive-poll-timeout.
+const pollTimeoutPerPortDay = 2 * time.Second
+
+// queryTimeout is how long to poll a query over ports service ports and the
+// given window. Adaptive mode scales with ports x days within the min/max
+// bounds; ports == 0 means any service and gets the max.
+func queryTimeout(ports int, window time.Duration) time.Duration {
+	if !adaptivePollTimeout {
+		return defaultPollTimeout
+	}
+	if ports == 0 {
+		return pollTimeoutMax
+	}
+	days := int64(window / (24 * time.Hour))
+	if days < 1 {
+		days = 1
+	}
+	t := pollTimeoutMin + time.Duration(int64(ports)*days)*pollTimeoutPerPortDay
+	if t > pollTimeoutMax {
+		t = pollTimeoutMax
+	}
+	return t
+}
+
+// asyncSem bounds the async queries alive on the PCE at once (-max-async).
+// -concurrency bounds app workers instead; one worker runs its windows in
+// sequence and baseline checks add more, so the two differ.
+var asyncSem chan struct{}
+
+// emptySubmitAttempts is how often an async query submit answered with an
+// empty 2xx body is tried before giving up.
+const emptySubmitAttempts = 2
+
+// runSingleAsyncQuery submits one async query, polls it to completion and
+// returns its flows_count.
+func runSingleAsyncQuery(ctx context.Context, baseURL string, payload map[string]interface{}, timeoutAfter time.Duration) (int64, error) {
+	_, flows, err := runAsyncQuery(ctx, baseURL, payload, timeoutAfter)
+	return flows, err
+}
+
+// runAsyncQuery is runSingleAsyncQuery that also returns the query href, so
+// the results can be downloaded. A nil error only ever comes with a
+// "completed" status and a flows_count the PCE actually sent; every other
+// outcome is an error, never a zero count.
+func runAsyncQuery(ctx context.Context, baseURL string, payload map[string]interface{}, timeoutAfter time.Duration) (string, int64, error) {
+	if asyncSem != nil {
+		select {
+		case asyncSem <- struct{}{}:
+			defer func() { <-asyncSem }()
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		}
+	}
+	if err := queryThrottle.wait(ctx); err != nil {
+		return "", 0, err
+	}
+	started := time.Now()
+	// timeouts and errors are the clearest stress signal, so every end but
+	// our own cancel is sampled
+	defer func() {
+		if ctx.Err() == nil {
+			queryThrottle.observe(time.Since(started))
+		}
+	}()
+	var respBytes []byte
+	for attempt := 1; ; attempt++ {
+		var err error
+		respBytes, err = apiRequestWithRetry(ctx, queryPCE, "POST", baseURL, payload)
+		if err != nil {
+			return "", 0, err
+		}
+		if len(bytes.TrimSpace(respBytes)) > 0 {
+			break
+		}
+		// seen behind some gateways: a 2xx with nothing in it
+		if attempt == emptySubmitAttempts {
+			return "", 0, fmt.Errorf("async query submit returned empty body - check gateway/path configuration")
+		}
+		vlog("Async query submit returned an empty body, retrying")
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(respBytes, &resp); err != nil {
+		return "", 0, fmt.Errorf("async query submit returned non-JSON body (check gateway/path configuration): %w", err)
+	}
+	href, ok := resp["href"].(string)
+	if !ok || href == "" {
+		return "", 0, fmt.Errorf("query failed to return href")
+	}
+
+	// whatever stops us polling before the PCE reports a terminal status
+	// (timeout, cancel, a failed poll) leaves the query holding a slot
+	terminal := false
+	defer func() {
+		if !terminal {
+			deleteAsyncQuery(href)
+		}
+	}()
+
+	timeout := time.After(timeoutAfter)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", 0, ctx.Err()
+		case <-timeout:
+			return "", 0, fmt.Errorf("query timed out after %s", timeoutAfter)
+		case <-ticker.C:
+			pollBytes, err := apiRequestWithRetry(ctx, queryPCE, "GET",
+				queryPCE.pceURL(href, nil), nil)
+			if err != nil {
+				return "", 0, err
+			}
+			var poll map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(pollBytes))
+			dec.UseNumber()
+			if err := dec.Decode(&poll); err != nil {
+				return "", 0, err
+			}
+			status, _ := poll["status"].(string)
+
+			switch status {
+			case "completed":
+				terminal = true
+				// a misread count would look like "no traffic" and deny the app
+				flowsCount, err := parseFlowsCount(poll["flows_count"])
+				if err != nil {
+					return "", 0, fmt.Errorf("async query %s: %w", href, err)
+				}
+				return href, flowsCount, nil
+			case "failed", "cancelled":
+				// terminal on the PCE side; polling on would only hit the timeout
+				terminal = true
+				for _, k := range []string{"error", "message"} {
+					if msg, _ := poll[k].(string); msg != "" {
+						return "", 0, fmt.Errorf("async query %s %s: %s", href, status, msg)
+					}
+				}
+				return "", 0, fmt.Errorf("async query %s %s", href, status)
+			}
+			// queued/working: keep polling
+		}
+	}
+}
+
+// parseFlowsCount reads flows_count whether the PCE sent it as a number or
+// a numeric string. A missing or unparseable count is an error, never 0.
+func parseFlowsCount(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, errors.New("flows_count missing")
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return 0, fmt.Errorf("flows_count %q: %w", n, err)
+		}
+		return int64(f), nil
+	case float64:
+		return int64(n), nil
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(n), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("flows_count %q: %w", n, err)
+		}
+		return i, nil
+	default:
+		return 0, fmt.Errorf("flows_count has unexpected type %T", v)
+	}
+}
+
+// deleteAsyncQuery frees the PCE's async query slot of a query we gave up
+// on. Best effort: failures are only logged.
+func deleteAsyncQuery(href string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	urlStr := queryPCE.pceURL(href, nil)
+	if _, err := apiRequestWithRetry(ctx, queryPCE, "DELETE", urlStr, nil); err != nil {
+		log.Printf("Failed to delete abandoned async query %s: %v", href, err)
+		return
+	}
+	vlog("Deleted abandoned async query %s", href)
+}
+
+func createRuleset(name, description string) (string, error) {
+	payload := map[string]interface{}{
+		"name":        name,
+		"description": description,
+		"scopes":      [][]interface{}{{}},
+	}
+	url := policyPCE.orgURL("/sec_policy/draft/rule_sets", nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "POST", url, payload)
+	if err != nil {
+		return "", err
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+	href, _ := resp["href"].(string)
+	return href, nil
+}
+
+// deleteEmptyRuleset deletes a rule set this run created, unless someone
+// has added deny rules to it in the meantime.
+func deleteEmptyRuleset(rulesetHref string) error {
+	rules, err := getExistingDenyRules(rulesetHref)
+	if err != nil {
+		return fmt.Errorf("deleteEmptyRuleset: %w", err)
+	}
+	if len(rules) > 0 {
+		return fmt.Errorf("it has %d deny rule(s), likely edited manually", len(rules))
+	}
+	urlStr := policyPCE.pceURL(rulesetHref, nil)
+	if _, err := apiRequestWithRetry(context.Background(), policyPCE, "DELETE", urlStr, nil); err != nil {
+		var se *httpStatusError
+		if errors.As(err, &se) && se.StatusCode < 500 {
+			return fmt.Errorf("PCE refused the delete (HTTP %d), it may have been edited manually: %w", se.StatusCode, err)
+		}
+		return fmt.Errorf("deleteEmptyRuleset: %w", err)
+	}
+	return nil
+}
+
+// getRulesetName fetches a draft rule set, failing if it doesn't exist.
+func getRulesetName(rulesetHref string) (string, error) {
+	urlStr := policyPCE.pceURL(rulesetHref, nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+	if err != nil {
+		return "", fmt.Errorf("getRulesetName: %w", err)
+	}
+	var rs struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return "", fmt.Errorf("getRulesetName unmarshal: %w", err)
+	}
+	return rs.Name, nil
+}
+
+// ruleDescription expands -rule-description-template for a rule and notes
+// the settings it was created with.
+func ruleDescription(dr denyRuleInfo) string {
+	var parts []string
+	if ruleDescriptionTemplate != "" {
+		parts = append(parts, strings.NewReplacer(
+			"{env}", dr.env.Value,
+			"{service}", dr.service.Name,
+			"{apps}", strings.Join(labelValues(dr.apps), ","),
+			"{run_id}", runID,
+		).Replace(ruleDescriptionTemplate))
+	}
+	if dr.parts > 1 {
+		parts = append(parts, fmt.Sprintf("part %d of %d", dr.part, dr.parts))
+	}
+	if len(useWorkloadSubnets) > 0 {
+		parts = append(parts, "use_workload_subnets: "+strings.Join(useWorkloadSubnets, ","))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// createDenyRules creates rules with up to concurrency POSTs in flight. A
+// failed rule doesn't stop the others; record is called for each outcome as
+// it happens, one call at a time.
+func createDenyRules(rulesetHref string, rules []denyRuleInfo, ipListHrefs []string, concurrency int, record func(dr denyRuleInfo, ruleHref string, err error)) {
+	var recordMu sync.Mutex
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, dr := range rules {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(dr denyRuleInfo) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ruleHref, err := createDenyRule(rulesetHref, dr, ipListHrefs)
+			if err != nil {
+				log.Printf("Failed to create deny rule for env %s service %s: %v",
+					dr.env.Value, dr.service.Name, err)
+			} else {
+				// Combined log line
+				done := atomic.AddInt64(&doneDenyRules, 1)
+				percent := float64(done) / float64(totalDenyRules) * 100
+				logf(map[string]interface{}{
+					"env": dr.env.Value, "service": dr.service.Name, "apps": labelValues(dr.apps),
+					"rule_href": ruleHref, "progress_pct": percent,
+				}, "Created deny rule for env %s service %s (apps: %d) – Progress: %.1f%% (%d/%d)",
+					dr.env.Value, dr.service.Name, len(dr.apps),
+					percent, done, totalDenyRules)
+				// End combined line
+			}
+			recordMu.Lock()
+			defer recordMu.Unlock()
+			record(dr, ruleHref, err)
+		}(dr)
+	}
+	wg.Wait()
+}
+
+// createDenyRule creates one deny rule. The PCE API has bulk_create only for
+// workloads-style collections, not rule set deny_rules, so rules go one POST
+// at a time; 429s are paced by apiRequestWithRetry.
+func createDenyRule(rulesetHref string, dr denyRuleInfo, ipListHrefs []string) (string, error) {
+	payload, err := denyRulePayload(dr, ipListHrefs)
+	if err != nil {
+		return "", err
+	}
+	url := policyPCE.pceURL(rulesetHref+"/deny_rules", nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "POST", url, payload)
+	if err != nil {
+		return "", err
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", err
+	}
+	href, _ := resp["href"].(string)
+	return href, nil
+}
+
+// denyRulePayload builds the POST body of a deny rule and checks it with
+// validateDenyRulePayload.
+func denyRulePayload(dr denyRuleInfo, ipListHrefs []string) (map[string]interface{}, error) {
+	if err := checkScopeDimensions(providerLabels(dr.env, dr.extras, dr.apps)); err != nil {
+		return nil, fmt.Errorf("rule providers: %w", err)
+	}
+	serviceHref := dr.service.Href
+	description := ruleDescription(dr)
+
+	ipLists := make([]map[string]map[string]string, 0, len(ipListHrefs))
+	for _, href := range ipListHrefs {
+		ipLists = append(ipLists, map[string]map[string]string{"ip_list": {"href": href}})
+	}
+	labels, groups := groupProviders(dr)
+	actors := labelRefs(labels)
+	for _, g := range groups {
+		actors = append(actors, map[string]map[string]string{"label_group": {"href": g.Href}})
+	}
+	var workloads, ipList interface{} = actors, ipLists
+	services, none := []map[string]string{{"href": serviceHref}}, []interface{}{}
+	payload := map[string]interface{}{
+		"providers":        workloads,
+		"consumers":        ipList,
+		"enabled":          true,
+		"ingress_services": services,
+		"egress_services":  none,
+		"network_type":     "brn",
+		"description":      description,
+	}
+	if dr.egress {
+		// the workloads originate the traffic and the IP-list receives it on
+		// the service, which stays the provider-side ingress service
+		payload["providers"], payload["consumers"] = ipList, workloads
+	}
+	if len(useWorkloadSubnets) > 0 {
+		payload["use_workload_subnets"] = useWorkloadSubnets
+	}
+	payload["external_data_set"] = externalDataSet
+	payload["external_data_reference"] = externalReference(dr.reference(ipListHrefs))
+	if err := validateDenyRulePayload(payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+var ipListHrefPattern = regexp.MustCompile(`^/orgs/[0-9]+/sec_policy/(draft|active)/ip_lists/[0-9]+$`)
+
+// validateDenyRulePayload checks a deny rule body locally, so a malformed
+// rule is reported with its cause instead of as a PCE 406.
+func validateDenyRulePayload(payload map[string]interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("invalid deny rule: %w", err)
+	}
+	var rule existingDenyRule
+	if err := json.Unmarshal(data, &rule); err != nil {
+		return fmt.Errorf("invalid deny rule: %w", err)
+	}
+	// ingress: label providers, ip_list consumers; egress the other way round
+	labelSide, labelName := rule.Providers, "provider"
+	ipListSide, ipListName := rule.Consumers, "consumer"
+	if len(rule.Providers) > 0 && rule.Providers[0].IPList != nil {
+		labelSide, labelName, ipListSide, ipListName = rule.Consumers, "consumer", rule.Providers, "provider"
+	}
+	if len(labelSide) == 0 {
+		return fmt.Errorf("invalid deny rule: no %ss", labelName)
+	}
+	for i, p := range labelSide {
+		switch {
+		case p.Label != nil && p.Label.Href != "":
+		case p.LabelGroup != nil && p.LabelGroup.Href != "":
+		default:
+			return fmt.Errorf("invalid deny rule: %s #%d has no label or label_group href", labelName, i+1)
+		}
+	}
+	if len(ipListSide) == 0 {
+		return fmt.Errorf("invalid deny rule: no %ss", ipListName)
+	}
+	for i, c := range ipListSide {
+		if c.IPList == nil {
+			return fmt.Errorf("invalid deny rule: %s #%d is not an ip_list", ipListName, i+1)
+		}
+		if !ipListHrefPattern.MatchString(c.IPList.Href) {
+			return fmt.Errorf("invalid deny rule: %s #%d has a malformed ip_list href %q", ipListName, i+1, c.IPList.Href)
+		}
+	}
+	if len(rule.IngressServices) == 0 {
+		return fmt.Errorf("invalid deny rule: no ingress_services")
+	}
+	for i, s := range rule.IngressServices {
+		if s.Href == "" {
+			return fmt.Errorf("invalid deny rule: ingress service #%d has no href", i+1)
+		}
+	}
+	return nil
+}
+
+// providerLabels is the provider label set of a deny rule: env, any extra
+// dimensions, then the apps.
+func providerLabels(env Label, extras, apps []Label) []Label {
+	labels := append([]Label{env}, extras...)
+	for _, a := range apps {
+		if a.Href != "" { // envWideScope
+			labels = append(labels, a)
+		}
+	}
+	return labels
+}
+
+// ruleReference is a deterministic tag for a deny rule, stored in
+// external_data_reference so later runs and -verify can recognize it.
+func ruleReference(providers []Label, serviceHref, ipListHref string) string {
+	hrefs := hrefsOf(providers)
+	sort.Strings(hrefs)
+	sum := sha256.Sum256([]byte(strings.Join(hrefs, ",") + "|" + serviceHref + "|" + ipListHref))
+	return hex.EncodeToString(sum[:16])
+}
+
+// externalReference is the external_data_reference stored for a rule:
+// its ruleReference, behind -rule-tag when one is set.
+func externalReference(ref string) string {
+	if ruleTag == "" {
+		return ref
+	}
+	return ruleTag + ":" + ref
+}
+
+type existingDenyRule struct {
+	Href                  string      `json:"href"`
+	Enabled               bool        `json:"enabled"`
+	Providers             []ruleActor `json:"providers"`
+	Consumers             []ruleActor `json:"consumers"`
+	IngressServices       []hrefRef   `json:"ingress_services"`
+	EgressServices        []hrefRef   `json:"egress_services"`
+	ExternalDataSet       string      `json:"external_data_set"`
+	ExternalDataReference string      `json:"external_data_reference"`
+}
+
+type hrefRef struct {
+	Href string `json:"href"`
+}
+
+// ruleActor is one provider or consumer of a rule; other actor kinds
+// (workloads, "ams") leave all fields nil.
+type ruleActor struct {
+	Label      *hrefRef `json:"label"`
+	LabelGroup *hrefRef `json:"label_group"`
+	IPList     *hrefRef `json:"ip_list"`
+}
+
+// getOrgDenyRules lists the deny rules of every draft rule set in the org.
+func getOrgDenyRules() ([]existingDenyRule, error) {
+	urlStr := policyPCE.orgURL("/sec_policy/draft/rule_sets", nil)
+	data, err := apiGetAll(context.Background(), policyPCE, urlStr)
+	if err != nil {
+		return nil, fmt.Errorf("getOrgDenyRules: %w", err)
+	}
+	var rulesets []struct {
+		DenyRules []existingDenyRule `json:"deny_rules"`
+	}
+	if err := json.Unmarshal(data, &rulesets); err != nil {
+		return nil, fmt.Errorf("getOrgDenyRules unmarshal: %w", err)
+	}
+	var rules []existingDenyRule
+	for _, rs := range rulesets {
+		rules = append(rules, rs.DenyRules...)
+	}
+	return rules, nil
+}
+
+// denyRuleIndex maps the denyRuleInfo.reference of every (labels,
+// ip-list, service, direction) an enabled rule covers to that rule's href.
+// Rules whose workload side isn't plain labels can't be compared and are
+// left out.
+func denyRuleIndex(rules []existingDenyRule) map[string]string {
+	index := make(map[string]string)
+	add := func(href string, labelSide, ipListSide []ruleActor, services []hrefRef, suffix string) {
+		labels := actorLabels(labelSide)
+		if len(labels) == 0 {
+			return
+		}
+		// a rule covers each of its IP-lists alone and the whole set
+		var ipLists []string
+		for _, a := range ipListSide {
+			if a.IPList != nil {
+				ipLists = append(ipLists, a.IPList.Href)
+			}
+		}
+		if len(ipLists) == 0 {
+			return
+		}
+		keys := append([]string{ipListSetKey(ipLists)}, ipLists...)
+		for _, k := range keys {
+			for _, svc := range services {
+				index[ruleReference(labels, svc.Href, k+suffix)] = href
+			}
+		}
+	}
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		add(r.Href, r.Providers, r.Consumers, r.IngressServices, "")
+		add(r.Href, r.Consumers, r.Providers, r.IngressServices, "|egress")
+	}
+	return index
+}
+
+// actorLabels returns the labels of actors, with -label-group groups
+// expanded to their members, or nil if any actor is something else.
+func actorLabels(actors []ruleActor) []Label {
+	var labels []Label
+	for _, a := range actors {
+		switch {
+		case a.Label != nil:
+			labels = append(labels, Label{Href: a.Label.Href})
+		case a.LabelGroup != nil:
+			g, ok := findLabelGroup(a.LabelGroup.Href)
+			if !ok {
+				return nil
+			}
+			for href := range g.members {
+				labels = append(labels, Label{Href: href})
+			}
+		default:
+			return nil
+		}
+	}
+	return labels
+}
+
+func findLabelGroup(href string) (labelGroup, bool) {
+	for _, g := range labelGroups {
+		if g.Href == href {
+			return g, true
+		}
+	}
+	return labelGroup{}, false
+}
+
+func getExistingDenyRules(rulesetHref string) ([]existingDenyRule, error) {
+	urlStr := policyPCE.pceURL(rulesetHref+"/deny_rules", nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getExistingDenyRules: %w", err)
+	}
+	var rules []existingDenyRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("getExistingDenyRules unmarshal: %w", err)
+	}
+	return rules, nil
+}
+
+// verifyDenyRules re-reads the rule set and returns the expected references
+// that did not persist.
+func verifyDenyRules(rulesetHref string, expected []string) ([]string, error) {
+	rules, err := getExistingDenyRules(rulesetHref)
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.ExternalDataSet == externalDataSet {
+			present[r.ExternalDataReference] = true
+		}
+	}
+	var missing []string
+	for _, ref := range expected {
+		if !present[ref] {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
+
+// provisionRuleset provisions the draft changes of one rule set, recording
+// note in the PCE's provisioning history.
+func provisionRuleset(rulesetHref, note string) (string, error) {
+	payload := map[string]interface{}{
+		"update_description": note,
+		"change_subset": map[string]interface{}{
+			"rule_sets": []map[string]string{{"href": rulesetHref}},
+		},
+	}
+	urlStr := policyPCE.orgURL("/sec_policy", nil)
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "POST", urlStr, payload)
+	if err != nil {
+		return "", fmt.Errorf("provisionRuleset: %w", err)
+	}
+	var resp map[string]interface{}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return "", fmt.Errorf("provisionRuleset unmarshal: %w", err)
+	}
+	href, _ := resp["href"].(string)
+	return href, nil
+}
+
+// provisionWaitTimeout bounds waitProvisioned.
+const provisionWaitTimeout = 2 * time.Minute
+
+// waitProvisioned polls the org's pending policy changes until the rule set
+// no longer shows up there, i.e. its draft has become active policy.
+func waitProvisioned(rulesetHref string) error {
+	urlStr := policyPCE.orgURL("/sec_policy/pending", nil)
+	deadline := time.Now().Add(provisionWaitTimeout)
+	for {
+		data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", urlStr, nil)
+		if err != nil {
+			return fmt.Errorf("waitProvisioned: %w", err)
+		}
+		var pending map[string][]struct {
+			Href string `json:"href"`
+		}
+		if err := json.Unmarshal(data, &pending); err != nil {
+			return fmt.Errorf("waitProvisioned unmarshal: %w", err)
+		}
+		stillPending := false
+		for _, rs := range pending["rule_sets"] {
+			if rs.Href == rulesetHref {
+				stillPending = true
+			}
+		}
+		if !stillPending {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("rule set %s still pending after %s", rulesetHref, provisionWaitTimeout)
+		}
+		vlog("Rule set %s still pending provisioning", rulesetHref)
+		time.Sleep(pollInterval)
+	}
+}
+
+func getIPListHref(targetName string) (string, error) {
+	urlStr := policyPCE.orgURL("/sec_policy/draft/ip_lists", url.Values{"name": {targetName}})
+
+	data, err := apiGetAll(context.Background(), policyPCE, urlStr)
+	if err != nil {
+		return "", fmt.Errorf("getIPListHref: %w", err)
+	}
+	var lists []struct {
+		Href string `json:"href"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &lists); err != nil {
+		return "", fmt.Errorf("getIPListHref unmarshal: %w", err)
+	}
+	// name= is a substring match on the PCE, so only an exact name counts
+	var matches []string
+	for _, l := range lists {
+		if l.Name == targetName {
+			matches = append(matches, l.Href)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no IP-list found with name %q (%d partial match(es))", targetName, len(lists))
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("%d IP-lists named %q: %s", len(matches), targetName, strings.Join(matches, ", "))
+	}
+}
+
+// getLabelGroup resolves an app label group by exact name, with the app
+// labels of the group and all its sub-groups.
+func getLabelGroup(targetName string) (labelGroup, error) {
+	urlStr := policyPCE.orgURL("/sec_policy/draft/label_groups", url.Values{"name": {targetName}})
+
+	data, err := apiGetAll(context.Background(), policyPCE, urlStr)
+	if err != nil {
+		return labelGroup{}, fmt.Errorf("getLabelGroup: %w", err)
+	}
+	var groups []struct {
+		Href string `json:"href"`
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	}
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return labelGroup{}, fmt.Errorf("getLabelGroup unmarshal: %w", err)
+	}
+	// name= is a substring match on the PCE, so only an exact name counts
+	var matches []string
+	for _, g := range groups {
+		if g.Name != targetName {
+			continue
+		}
+		if g.Key != "app" {
+			return labelGroup{}, fmt.Errorf("label group %q is a %q group, not an app group", targetName, g.Key)
+		}
+		matches = append(matches, g.Href)
+	}
+	switch len(matches) {
+	case 0:
+		return labelGroup{}, fmt.Errorf("no label group found with name %q (%d partial match(es))", targetName, len(groups))
+	case 1:
+	default:
+		return labelGroup{}, fmt.Errorf("%d label groups named %q: %s", len(matches), targetName, strings.Join(matches, ", "))
+	}
+	g := labelGroup{Href: matches[0], Name: targetName, members: make(map[string]bool)}
+	if err := expandLabelGroup(g.Href, g.members, make(map[string]bool)); err != nil {
+		return labelGroup{}, err
+	}
+	return g, nil
+}
+
+// expandLabelGroup adds the labels of a label group and, recursively, of
+// its sub-groups to members.
+func expandLabelGroup(href string, members, seen map[string]bool) error {
+	if seen[href] {
+		return nil
+	}
+	seen[href] = true
+	data, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.pceURL(href, nil), nil)
+	if err != nil {
+		return fmt.Errorf("expandLabelGroup: %w", err)
+	}
+	var group struct {
+		Labels    []hrefRef `json:"labels"`
+		SubGroups []hrefRef `json:"sub_groups"`
+	}
+	if err := json.Unmarshal(data, &group); err != nil {
+		return fmt.Errorf("expandLabelGroup unmarshal: %w", err)
+	}
+	for _, l := range group.Labels {
+		members[l.Href] = true
+	}
+	for _, sg := range group.SubGroups {
+		if err := expandLabelGroup(sg.Href, members, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func buildDestExclusions(broadcast, multicast bool) []interface{} {
+	excl := make([]interface{}, 0)
+	if broadcast {
+		excl = append(excl, map[string]string{"transmission": "broadcast"})
+	}
+	if multicast {
+		excl = append(excl, map[string]string{"transmission": "multicast"})
+	}
+	return excl
+}
+
+// blockedRule is a deny rule held back by -max-deny-fraction, with the
+// fraction of its env's apps that would have been denied for the service.
+type blockedRule struct {
+	dr       denyRuleInfo
+	fraction float64
+}
+
+// planEntry is one deny rule as written to -output-json and -rule-report.
+type planEntry struct {
+	Env         Label    `json:"env"`
+	Service     string   `json:"service"`
+	ServiceHref string   `json:"service_href"`
+	Apps        []Label  `json:"apps"`
+	Extras      []Label  `json:"extras,omitempty"`
+	IPListHrefs []string `json:"ip_list_hrefs"`
+	LabelGroups []string `json:"label_group_hrefs,omitempty"`
+	Direction   string   `json:"direction"`
+	Status      string   `json:"status"`
+	Reason      string   `json:"reason,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+func newPlanEntry(dr denyRuleInfo, ipListHrefs []string, status string, err error) planEntry {
+	entry := planEntry{
+		Env:         dr.env,
+		Service:     dr.service.Name,
+		ServiceHref: dr.service.Href,
+		Apps:        dr.apps,
+		Extras:      dr.extras,
+		IPListHrefs: ipListHrefs,
+		Direction:   dr.direction(),
+		Status:      status,
+	}
+	_, groups := groupProviders(dr)
+	for _, g := range groups {
+		entry.LabelGroups = append(entry.LabelGroups, g.Href)
+	}
+	if err != nil {
+		entry.Status, entry.Error = "failed", err.Error()
+	}
+	return entry
+}
+
+const version = "0.2.0"
+
+// decisions recorded per env/app/service combination
+const (
+	decisionDeny         = "deny"
+	decisionTraffic      = "traffic"
+	decisionInconclusive = "inconclusive"
+	decisionError        = "error"
+)
+
+// guardQuery, deferred by each query goroutine, hands a panic to onPanic.
+func guardQuery(onPanic func(r interface{})) {
+	if r := recover(); r != nil {
+		onPanic(r)
+	}
+}
+
+// queryOutcome is the analysis result for one env/app/service combination.
+type queryOutcome struct {
+	Env      Label          `json:"env"`
+	App      Label          `json:"app"`
+	Extras   []Label        `json:"extras,omitempty"`
+	Service  Service        `json:"service"`
+	Decision string         `json:"decision"`
+	Reason   string         `json:"reason,omitempty"`
+	Windows  []windowResult `json:"windows"`
+}
+
+type reportGroup struct {
+	Env      string
+	Service  string
+	Outcomes []queryOutcome
+}
+
+type reportData struct {
+	Version   string
+	RunID     string
+	Generated string
+	PCE       string
+	Windows   string
+	Total     int
+	Denied    int
+	Groups    []reportGroup
+	Problems  []queryOutcome
+}
+
+const textReport = `Auto Deny Rules - Compliance Report
+===================================
+Tool version: {{.Version}}
+Run ID:       {{.RunID}}
+Generated:    {{.Generated}}
+PCE:          {{.PCE}}
+Windows:      {{.Windows}}
+
+Combinations analyzed: {{.Total}}
+Safe to deny:          {{.Denied}}
+Inconclusive/errored:  {{len .Problems}}
+
+Apps with no traffic
+--------------------
+{{range .Groups}}Env {{.Env}} / Service {{.Service}}
+{{range .Outcomes}}  - {{.App.Value}}
+{{range .Windows}}      {{.Window}} window {{.Start}} to {{.End}}: {{.Flows}} flows
+{{end}}{{end}}
+{{else}}(none)
+
+{{end}}Inconclusive / errored combinations
+-----------------------------------
+{{range .Problems}}  - Env {{.Env.Value}} / App {{.App.Value}} / Service {{.Service.Name}}: {{.Decision}} ({{.Reason}})
+{{else}}(none)
+{{end}}`
+
+const htmlReport = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Auto Deny Rules - Compliance Report {{.RunID}}</title></head>
+<body>
+<h1>Auto Deny Rules - Compliance Report</h1>
+<table>
+<tr><th align="left">Tool version</th><td>{{.Version}}</td></tr>
+<tr><th align="left">Run ID</th><td>{{.RunID}}</td></tr>
+<tr><th align="left">Generated</th><td>{{.Generated}}</td></tr>
+<tr><th align="left">PCE</th><td>{{.PCE}}</td></tr>
+<tr><th align="left">Windows</th><td>{{.Windows}}</td></tr>
+<tr><th align="left">Combinations analyzed</th><td>{{.Total}}</td></tr>
+<tr><th align="left">Safe to deny</th><td>{{.Denied}}</td></tr>
+<tr><th align="left">Inconclusive/errored</th><td>{{len .Problems}}</td></tr>
+</table>
+<h2>Apps with no traffic</h2>
+{{range .Groups}}<h3>Env {{.Env}} / Service {{.Service}}</h3>
+<table border="1" cellpadding="4">
+<tr><th>App</th><th>Window</th><th>Start</th><th>End</th><th>Flows</th></tr>
+{{range .Outcomes}}{{$app := .App.Value}}{{range .Windows}}<tr><td>{{$app}}</td><td>{{.Window}}</td><td>{{.Start}}</td><td>{{.End}}</td><td>{{.Flows}}</td></tr>
+{{end}}{{end}}</table>
+{{else}}<p>(none)</p>
+{{end}}<h2>Inconclusive / errored combinations</h2>
+{{if .Problems}}<table border="1" cellpadding="4">
+<tr><th>Env</th><th>App</th><th>Service</th><th>Decision</th><th>Reason</th></tr>
+{{range .Problems}}<tr><td>{{.Env.Value}}</td><td>{{.App.Value}}</td><td>{{.Service.Name}}</td><td>{{.Decision}}</td><td>{{.Reason}}</td></tr>
+{{end}}</table>
+{{else}}<p>(none)</p>
+{{end}}</body></html>
+`
+
+// sortedOutcomes returns a copy of outcomes ordered by env, service, app.
+func sortedOutcomes(outcomes []queryOutcome) []queryOutcome {
+	sorted := append([]queryOutcome(nil), outcomes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Env.Value != b.Env.Value {
+			return a.Env.Value < b.Env.Value
+		}
+		if a.Service.Name != b.Service.Name {
+			return a.Service.Name < b.Service.Name
+		}
+		return a.App.Value < b.App.Value
+	})
+	return sorted
+}
+
+// writeCSV writes one row per env/app/service combination for -csv.
+// blocked holds the env+service hrefs held back by -max-deny-fraction,
+// whose deny candidates end up skipped.
+func writeCSV(path string, outcomes []queryOutcome, blocked map[string]bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"env", "app", "extras", "service", "ports", "traffic_found", "decision"})
+	for _, o := range sortedOutcomes(outcomes) {
+		traffic, decision := "", o.Decision
+		switch o.Decision {
+		case decisionTraffic:
+			traffic = "yes"
+		case decisionDeny:
+			traffic = "no"
+			if blocked[o.Env.Href+" "+o.Service.Href] {
+				decision = "skipped"
+			}
+		}
+		w.Write([]string{
+			o.Env.Value, o.App.Value, strings.Join(labelValues(o.Extras), ", "),
+			o.Service.Name, describePorts(o.Service.ServicePorts), traffic, decision,
+		})
+	}
+	w.Flush()
+	err = w.Error()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeReport writes the sign-off report: HTML for .html/.htm paths,
+// plain text otherwise.
+func writeReport(path string, outcomes []queryOutcome) error {
+	sorted := sortedOutcomes(outcomes)
+
+	data := reportData{
+		Version:   version,
+		RunID:     runID,
+		Generated: time.Now().Format(time.RFC3339),
+		PCE:       queryPCE.String(),
+		Windows:   fmt.Sprintf("%s, then %s when the first had no flows", formatWindow(shortWindow), formatWindow(longWindow)),
+		Total:     len(sorted),
+	}
+	if singleWindow {
+		data.Windows = formatWindow(longWindow) + " only"
+	}
+	for _, o := range sorted {
+		switch o.Decision {
+		case decisionDeny:
+			data.Denied++
+			n := len(data.Groups)
+			if n == 0 || data.Groups[n-1].Env != o.Env.Value || data.Groups[n-1].Service != o.Service.Name {
+				data.Groups = append(data.Groups, reportGroup{Env: o.Env.Value, Service: o.Service.Name})
+				n++
+			}
+			data.Groups[n-1].Outcomes = append(data.Groups[n-1].Outcomes, o)
+		case decisionInconclusive, decisionError:
+			data.Problems = append(data.Problems, o)
+		}
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".html" || ext == ".htm" {
+		err = htmltemplate.Must(htmltemplate.New("report").Parse(htmlReport)).Execute(f, data)
+	} else {
+		err = template.Must(template.New("report").Parse(textReport)).Execute(f, data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// runResult is printed as the final "RESULT {json}" line on stdout, giving
+// wrapper scripts a stable contract instead of scraping the log.
+type runResult struct {
+	Type              string   `json:"type,omitempty"`
+	RulesetHref       string   `json:"ruleset_href"`
+	RuleHrefs         []string `json:"rule_hrefs"`
+	QueriesTotal      int64    `json:"queries_total"`
+	QueriesDone       int64    `json:"queries_done"`
+	DenyRulesPlanned  int64    `json:"deny_rules_planned"`
+	DenyRulesCreated  int64    `json:"deny_rules_created"`
+	DenyRulesFailed   int64    `json:"deny_rules_failed"`
+	DenyRulesExisting int64    `json:"deny_rules_existing"`
+	TimedOut          bool     `json:"timed_out"`
+	DryRun            bool     `json:"dry_run"`
+}
+
+func emitResult(r runResult) {
+	if r.RuleHrefs == nil {
+		r.RuleHrefs = []string{}
+	}
+	if ndjsonOut != nil {
+		// the result is also the last NDJSON record, for consumers that
+		// drop the RESULT line
+		record := r
+		record.Type = "result"
+		if err := ndjsonOut.Write(record); err != nil {
+			log.Printf("Failed to write NDJSON result: %v", err)
+		}
+	}
+	// wrappers rely on this line whatever the log or output format
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("Failed to encode RESULT line: %v", err)
+		return
+	}
+	fmt.Printf("RESULT %s\n", data)
+}
+
+func marshalJSON(v interface{}) ([]byte, error) {
+	if prettyJSON {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := marshalJSON(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// jsonArrayWriter streams a JSON array to disk one element at a time, so
+// entries survive even if the run dies before the end.
+type jsonArrayWriter struct {
+	mu sync.Mutex
+	f  *os.File
+	n  int
+}
+
+func newJSONArrayWriter(path string) (*jsonArrayWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString("["); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &jsonArrayWriter{f: f}, nil
+}
+
+func (w *jsonArrayWriter) Write(v interface{}) error {
+	data, err := marshalJSON(v)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	sep := ","
+	if w.n == 0 {
+		sep = ""
+	}
+	if prettyJSON {
+		sep += "\n  "
+		data = bytes.ReplaceAll(data, []byte("\n"), []byte("\n  "))
+	}
+	w.n++
+	_, err = w.f.WriteString(sep + string(data))
+	return err
+}
+
+func (w *jsonArrayWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	end := "]\n"
+	if prettyJSON && w.n > 0 {
+		end = "\n]\n"
+	}
+	if _, err := w.f.WriteString(end); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// ndjsonWriter writes one compact JSON object per line, serializing
+// concurrent writers so lines never interleave.
+type ndjsonWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// ndjsonOut is set by -output-ndjson; nil means stdout carries only RESULT.
+var ndjsonOut *ndjsonWriter
+
+func (w *ndjsonWriter) Write(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(append(data, '\n'))
+	return err
+}
+
+// ndjsonOutcome is one -output-ndjson line per evaluated combination.
+type ndjsonOutcome struct {
+	Type string `json:"type"`
+	queryOutcome
+	Flows int64 `json:"flows"`
+}
+
+func newNDJSONOutcome(o queryOutcome) ndjsonOutcome {
+	var flows int64
+	for _, w := range o.Windows {
+		flows += w.Flows
+	}
+	return ndjsonOutcome{Type: "outcome", queryOutcome: o, Flows: flows}
+}
+
+func describeLabels(labels []Label) string {
+	parts := make([]string, 0, len(labels))
+	for _, l := range labels {
+		parts = append(parts, fmt.Sprintf("%s:%s", l.Key, l.Value))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func describePorts(ports []ServicePort) string {
+	parts := make([]string, 0, len(ports))
+	for _, sp := range ports {
+		p := fmt.Sprintf("%d", sp.Port)
+		if sp.ToPort != 0 {
+			p = fmt.Sprintf("%d-%d", sp.Port, sp.ToPort)
+		}
+		parts = append(parts, fmt.Sprintf("%s/%d", p, sp.Proto))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// confirmSampleRules is how many planned rules -interactive shows in full.
+const confirmSampleRules = 5
+
+// confirmCreate shows the rule plan and asks for a typed "yes" on stdin.
+// Without a terminal to ask on, the answer is no.
+func confirmCreate(rules []denyRuleInfo, ipListHrefs []string) bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		log.Println("-interactive: stdin is not a terminal; pass -yes to create rules unattended")
+		return false
+	}
+	apps := 0
+	for _, dr := range rules {
+		apps += len(dr.apps)
+	}
+	log.Printf("About to create %d deny rule(s) covering %d app(s):", len(rules), apps)
+	for i := 0; i < confirmSampleRules && i < len(rules); i++ {
+		printRulePreview(i+1, rules[i], ipListHrefs)
+	}
+	if len(rules) > confirmSampleRules {
+		log.Printf("... and %d more", len(rules)-confirmSampleRules)
+	}
+	fmt.Fprint(os.Stderr, "Type yes to create these deny rules: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
+
+// printRulePreview logs one planned deny rule in full for -dry-run-sample-output.
+func printRulePreview(n int, dr denyRuleInfo, ipListHrefs []string) {
+	log.Printf("Planned deny rule #%d", n)
+	labels, groups := groupProviders(dr)
+	workloads, ipList := describeLabels(labels), "ip_list "+strings.Join(ipListHrefs, ", ip_list ")
+	for _, g := range groups {
+		workloads += fmt.Sprintf(", label_group %s (%s)", g.Name, g.Href)
+	}
+	if dr.egress {
+		workloads, ipList = ipList, workloads
+	}
+	log.Printf("  direction: %s", dr.direction())
+	log.Printf("  providers: %s", workloads)
+	log.Printf("  consumers: %s", ipList)
+	log.Printf("  service:   %s (%s) ports %s", dr.service.Name, dr.service.Href, describePorts(dr.service.ServicePorts))
+	log.Printf("  windows:   %s", describeWindows())
+}
+
+// orderWork sorts envs, services and apps in place so the live progress log
+// advances in a predictable order. "name" sorts everything by value/name;
+// "largest-env-first" puts envs with the most apps first.
+func orderWork(envInfos []envInfo, services []Service, order string) error {
+	switch order {
+	case "name":
+		sort.SliceStable(envInfos, func(i, j int) bool {
+			return envInfos[i].env.Value < envInfos[j].env.Value
+		})
+	case "largest-env-first":
+		sort.SliceStable(envInfos, func(i, j int) bool {
+			if len(envInfos[i].apps) != len(envInfos[j].apps) {
+				return len(envInfos[i].apps) > len(envInfos[j].apps)
+			}
+			return envInfos[i].env.Value < envInfos[j].env.Value
+		})
+	default:
+		return fmt.Errorf("unknown order %q (allowed: name, largest-env-first)", order)
+	}
+	sort.SliceStable(services, func(i, j int) bool {
+		return services[i].Name < services[j].Name
+	})
+	for _, ei := range envInfos {
+		apps := ei.apps
+		sort.SliceStable(apps, func(i, j int) bool {
+			if apps[i].app.Value != apps[j].app.Value {
+				return apps[i].app.Value < apps[j].app.Value
+			}
+			return labelsKey(apps[i].extras) < labelsKey(apps[j].extras)
+		})
+	}
+	return nil
+}
+
+// estimateComboTime guesses how long querying all apps of one combination
+// takes with the given worker count.
+func estimateComboTime(apps, workers int, perQuery time.Duration) time.Duration {
+	rounds := (apps + workers - 1) / workers
+	return time.Duration(rounds) * perQuery
+}
+
+func buildSourceExclusions(ipListHrefs, cidrs []string) []interface{} {
+	excl := make([]interface{}, 0, len(ipListHrefs)+len(cidrs))
+	for _, href := range ipListHrefs {
+		excl = append(excl, map[string]map[string]string{"ip_list": {"href": href}})
+	}
+	for _, cidr := range cidrs {
+		excl = append(excl, map[string]string{"ip_address": cidr})
+	}
+	return excl
+}
+
+// progressBar is set by -progress bar on a terminal; barDrawn (guarded by
+// logMu) says the bar is on the current stderr line.
+var progressBar, barDrawn bool
+
+const barWidth = 30
+
+// drawProgressBar redraws the single-line progress bar in place.
+func drawProgressBar(env Label, svc Service, done, total int64) {
+	percent := float64(done) / float64(total) * 100
+	filled := int(done * barWidth / total)
+	line := fmt.Sprintf("\r\033[K[%s%s] %5.1f%% (%d/%d) env %s service %s",
+		strings.Repeat("#", filled), strings.Repeat("-", barWidth-filled),
+		percent, done, total, redact(env.Value), svc.Name)
+	logMu.Lock()
+	defer logMu.Unlock()
+	fmt.Fprint(os.Stderr, line)
+	barDrawn = true
+}
+
+// finishProgressBar moves past the bar so later output starts on a new line.
+func finishProgressBar() {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if barDrawn {
+		fmt.Fprintln(os.Stderr)
+		barDrawn = false
+	}
+}
+
+// logQueryProgress logs a finished query. With the progress bar the
+// terminal gets the bar, while file sinks still get every line.
+func logQueryProgress(env Label, app appScope, svc Service, done, total int64) {
+	percent := float64(done) / float64(total) * 100
+	fields := map[string]interface{}{
+		"env": env.Value, "app": app.app.Value, "service": svc.Name,
+		"progress_pct": percent, "done": done, "total": total,
+	}
+	msg := fmt.Sprintf("[Query] Env:%s  App:%s  Service:%s  →  Progress: %.1f%% (%d/%d)",
+		env.Value, app.app.Value, svc.Name, percent, done, total)
+	if progressBar {
+		drawProgressBar(env, svc, done, total)
+		writeEvent(false, "info", fields, msg)
+		return
+	}
+	logEvent("info", fields, msg)
+}
+
+// acquire takes a slot of sem, giving up when ctx is done first. A nil sem
+// has unlimited slots.
+func acquire(ctx context.Context, sem chan struct{}) bool {
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release frees a slot taken by acquire.
+func release(sem chan struct{}) {
+	if sem != nil {
+		<-sem
+	}
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run is the whole program; it returns the exit code instead of exiting,
+// so deferred cleanup (log and cache files, the metrics server) always runs.
+func run() int {
+	configPath := flag.String("config", "", "JSON file with PCE connection settings (fqdn, port, org, user, key; optional concurrency, timeout)")
+	profile := flag.String("profile", "", "Named block under \"profiles\" in the -config file to use")
 	excludeBroadcast := flag.Bool("exclude-broadcast", false, "Add broadcast transmission to destinations.exclude")
 	excludeMulticast := flag.Bool("exclude-multicast", false, "Add multicast transmission to destinations.exclude")
 	flag.BoolVar(&verbose, "verbose", false, "Show detailed logs (payloads, raw responses, etc.)")
+	flag.BoolVar(&strict, "strict", false, "Never trust a doubtful zero-flow result (e.g. stale label hrefs) as safe to deny")
+	outputJSON := flag.String("output-json", "", "Stream the deny rule plan and creation status to this JSON file")
+	summaryJSON := flag.String("summary-json", "", "Write a JSON summary of the run to this file")
+	maxDenyFraction := flag.Float64("max-deny-fraction", 0, "Refuse to create rules for an env/service when more than this fraction of its apps would be denied (0 disables)")
+	outputNDJSON := flag.Bool("output-ndjson", false, "Stream one JSON object per evaluated combination to stdout as it completes; the run result is the last record, followed as always by the RESULT line (drop it with grep -v '^RESULT ' for pure NDJSON)")
+	flag.BoolVar(&prettyJSON, "pretty", false, "Indent -output-json/-summary-json with two spaces (default compact)")
+	var envHrefs stringList
+	flag.Var(&envHrefs, "env-href", "Only use these env label hrefs (repeatable or comma-separated); overrides value-based env selection")
+	flag.DurationVar(&queryThrottle.threshold, "throttle-on-latency", 0, "Slow new query submissions while the rolling average query latency exceeds this (e.g. 2m; 0 disables)")
+	workloadSubnets := flag.String("use-workload-subnets", "", "Set use_workload_subnets on deny rules: providers, consumers or both (default omitted)")
+	dryRun := flag.Bool("dry-run", false, "Run all queries but do not create the rule set or any deny rules")
+	createConcurrency := flag.Int("create-concurrency", 1, "Deny rules created in parallel in the rule set; PCE 429s are still paced by the retry loop")
+	interactive := flag.Bool("interactive", false, "Show the rule plan and require typing yes before creating deny rules; without a terminal nothing is created")
+	assumeYes := flag.Bool("yes", false, "Answer yes to the -interactive prompt, for automation")
+	sampleOutput := flag.Int("dry-run-sample-output", 0, "Print the first N planned deny rules in full detail")
+	limit := flag.Int("limit", 0, "Run at most this many traffic queries, then create rules from what was found (0 = no limit; for smoke tests)")
+	runtimeBudget := flag.Duration("max-runtime-budget", 0, "Analyze the largest env/service combinations first and stop starting new ones when this budget is nearly spent (0 disables)")
+	estimatedQueryTime := flag.Duration("estimated-query-time", 30*time.Second, "Per-app query time assumed by -max-runtime-budget until real timings are measured")
+	verify := flag.Bool("verify", false, "After creation, re-read the rule set and report any created deny rule that did not persist")
+	cleanupEmpty := flag.Bool("cleanup-empty", true, "Delete the rule set created by this run when none of its deny rules could be created")
+	flag.IntVar(&sampleFlows, "sample-flows", 0, "Download up to this many flow records per window that saw traffic and include them in the outputs (0: counts only)")
+	failFast := flag.Bool("fail-fast", false, "Abort the run on the first query error instead of logging it and continuing")
+	cachePath := flag.String("cache", "", "Persist finished env/app/service results to this file and skip them when a run is resumed")
+	cacheMaxAge := flag.Duration("cache-max-age", 24*time.Hour, "Re-query -cache results older than this, as traffic may have appeared since (0 trusts any age)")
+	flag.StringVar(&ruleDirection, "direction", ruleDirection, "Deny rule direction: ingress (traffic from the IP-list), egress (traffic to it, queried as flows the apps send) or both (one rule each, denied only when neither direction has flows)")
+	queryMode := flag.String("query-mode", "per-app", "per-app: one async query per env/app/service; per-service: one query per env/service with a row per app, attributing flows from the downloaded results")
+	existingRuleset := flag.String("existing-ruleset", "", "Add deny rules to this draft rule set href instead of creating a new rule set")
+	var ipListNames stringList
+	flag.Var(&ipListNames, "ip-list", "Names of the IP-lists the deny rules block traffic from, all consumers of each rule (repeatable or comma-separated; default \"Any (0.0.0.0/0 and ::/0)\")")
+	var labelGroupNames stringList
+	flag.Var(&labelGroupNames, "label-group", "Names of app label groups to name as deny rule providers in place of their member app labels, for rules that cover every member (repeatable or comma-separated)")
+	var excludeSourceIPLists stringList
+	flag.Var(&excludeSourceIPLists, "exclude-source-ip-lists", "IP-list names whose traffic is ignored via sources.exclude (repeatable or comma-separated)")
+	var excludeSourceCIDRs stringList
+	flag.Var(&excludeSourceCIDRs, "exclude-source-cidr", "Source CIDR (e.g. a scanner subnet) whose traffic is ignored via sources.exclude (repeatable or comma-separated)")
+	progressMode := flag.String("progress", "line", "Query progress display: line (one log line per query) or bar (a single updating bar on a terminal; lines when not a TTY or with -verbose)")
+	logFormat := flag.String("log-format", "text", "Terminal log format: text or json (one object per line with level and fields like env, app, service, progress_pct)")
+	jsonLogFile := flag.String("json-logs-to-file", "", "Also append logs as JSON lines to this file; human-readable logs stay on stderr, as stdout is reserved for the RESULT line and -output-ndjson")
+	policyDecisionsFlag := flag.String("policy-decisions", "", "Only count flows with these policy decisions as traffic: allowed, potentially_blocked, blocked, unknown (default all). Narrowing this means flows outside the list never block a deny rule")
+	boundaryDecisionsFlag := flag.String("boundary-decisions", "", "Only count flows with these boundary decisions as traffic: blocked, blocked_by_override_deny, blocked_non_illumio_rule (default all)")
+	flag.StringVar(&apiVersion, "api-version", apiVersion, "PCE REST API version used in every request path (/api/<version>/...)")
+	runTimeout := flag.Duration("run-timeout", 0, "Stop launching and cancel traffic queries this long after startup, then create deny rules from the completed ones (0 = no limit)")
+	metricsAddr := flag.String("metrics-addr", "", "Serve Prometheus-style run metrics at /metrics on this address while queries and rule creation run (e.g. 9102; binds to localhost unless a host is given)")
+	pprofAddr := flag.String("pprof-addr", "", "Serve net/http/pprof on this address for debugging stuck runs (e.g. 6060; binds to localhost unless a host is given)")
+	requireBaseline := flag.Bool("require-baseline", false, "Only deny when the env/app scope shows some traffic on any service in the long window; otherwise mark it inconclusive")
+	flag.IntVar(&retryAttempts, "retries", retryAttempts, "Attempts per API request before giving up")
+	flag.DurationVar(&retryBackoffBase, "backoff-base", retryBackoffBase, "Delay after the first failed attempt; doubles per attempt up to -retry-max-backoff")
+	flag.DurationVar(&retryMaxBackoff, "retry-max-backoff", retryMaxBackoff, "Upper bound for the exponential retry backoff")
+	flag.Float64Var(&retryJitter, "retry-jitter", retryJitter, "Fraction (0-1) of each retry backoff that is randomized; 1 is full jitter")
+	continueOnEnvError := flag.Bool("continue-on-env-error", false, "Skip what fails to set up instead of aborting the run: an env (stale env label, workload listing error) or an -ip-list name that doesn't resolve; a rule set that can't be created then fails only its rules")
+	describe := flag.Bool("describe-query", false, "Print the async query payloads for -env/-app/-service without submitting anything, then exit")
+	var envValues stringList
+	flag.Var(&envValues, "env", "Only analyze these env label values, case-insensitive (repeatable or comma-separated); also the env for -describe-query")
+	var appValues stringList
+	flag.Var(&appValues, "app", "Only analyze these app label values, case-insensitive (repeatable or comma-separated); also the app for -describe-query")
+	flag.StringVar(&servicesFile, "services-file", "", "JSON file of services (href, name, service_ports) to analyze instead of the PCE's ransomware services")
+	var serviceNames stringList
+	flag.Var(&serviceNames, "service", "Only query these service names (repeatable or comma-separated); also the service for -describe-query")
+	setupConcurrency := flag.Int("setup-concurrency", 4, "Number of envs whose workloads are fetched in parallel at startup")
+	flag.BoolVar(&redactLogs, "redact", false, "Mask hrefs, label values, IP addresses and the PCE host in all log output with stable per-run tokens")
+	maxAppsPerRule := flag.Int("max-apps-per-rule", 0, "Split deny rules so each has at most this many app providers (0 means no cap)")
+	resolveSources := flag.String("resolve-sources-as", "", "resolve_labels_as for query sources: workloads, container_hosts or both (default PCE behavior)")
+	resolveDestinations := flag.String("resolve-destinations-as", "", "resolve_labels_as for query destinations: workloads, container_hosts or both. With only workloads, flows to pods on a labeled container host are not counted, so a busy Kubernetes app can look unused")
+	saveQueriesFlag := flag.Bool("save-queries", false, "Also save each combination's queries as explorer saved queries tagged with the run ID (adds a PCE object per window and direction of each combination)")
+	cleanupSavedQueries := flag.Bool("cleanup-saved-queries", false, "Delete this run's saved queries again when the run ends")
+	rulesetDescription := flag.String("ruleset-description", "Created by Auto Deny Rules script.", "Description of the created rule set")
+	flag.StringVar(&ruleDescriptionTemplate, "rule-description-template", defaultRuleDescription, "Deny rule description; {env}, {service}, {apps} and {run_id} (which starts with the run's timestamp) are replaced per rule")
+	flag.StringVar(&ruleDescriptionTemplate, "rule-description", defaultRuleDescription, "Alias of -rule-description-template")
+	flag.StringVar(&ruleTag, "rule-tag", "", "Tag such as a change ticket, stored with each rule as the prefix of its external_data_reference (external_data_set is always auto-deny-rules)")
+	provision := flag.Bool("provision", false, "Provision the rule set after its deny rules are created")
+	provisionNote := flag.String("provision-note", "", "Note recorded in the PCE provisioning history (default mentions the run ID)")
+	var conn Config
+	flag.StringVar(&conn.FQDN, "fqdn", "", "PCE hostname (overrides PCE_FQDN, -config and the default)")
+	flag.StringVar(&conn.Port, "port", "", "PCE port (overrides PCE_PORT, -config and the default)")
+	flag.StringVar(&conn.Org, "org", "", "PCE org ID (overrides PCE_ORG, -config and the default)")
+	flag.StringVar(&conn.User, "user", "", "API user (overrides PCE_API_USER, -config and the default)")
+	flag.StringVar(&conn.Key, "key", "", "API key (overrides PCE_API_KEY, -config and the default)")
+	maxAsync := flag.Int("max-async", 5, "Max async traffic queries alive on the PCE at once across all workers; keep at or below the PCE's per-user async query limit")
+	concurrency := flag.Int("concurrency", queryConcurrency, "Max concurrent traffic queries; too high a value hits the PCE's async query limit (429s). Overrides the config file concurrency")
+	httpTimeout := flag.Duration("http-timeout", httpClient.Timeout, "Per-request HTTP timeout (e.g. 45s, 2m); separate from the async query poll timeout. Overrides the config file timeout")
+	proxy := flag.String("proxy", "", "HTTP(S) proxy URL for all PCE requests (default: HTTPS_PROXY/NO_PROXY from the environment)")
+	caBundle := flag.String("ca-bundle", "", "PEM file of CA certificates to trust for the PCE instead of the system store")
+	insecure := flag.Bool("insecure", false, "Skip TLS certificate verification (self-signed lab PCEs only)")
+	var queryConn Config
+	flag.StringVar(&queryConn.FQDN, "query-fqdn", "", "Separate reporting PCE for traffic queries (defaults to the policy PCE)")
+	flag.StringVar(&queryConn.Port, "query-port", "", "Port of the query PCE (defaults to the policy PCE port)")
+	flag.StringVar(&queryConn.Org, "query-org", "", "Org of the query PCE (defaults to the policy PCE org)")
+	flag.StringVar(&queryConn.User, "query-user", "", "API user of the query PCE (defaults to the policy PCE user)")
+	flag.StringVar(&queryConn.Key, "query-key", "", "API key of the query PCE (defaults to the policy PCE key)")
+	order := flag.String("order", "name", "Query order for live progress: name (envs, services, apps alphabetically) or largest-env-first")
+	csvPath := flag.String("csv", "", "Write one CSV row per env/app/service combination (ports, traffic found, decision) to this file")
+	outputDir := flag.String("output-dir", "", "Write this run's artifacts to a new per-run subdirectory here: a copy of the log, -rule-report (default rules.json), -csv (default decisions.csv) and relative -report/-output-json/-summary-json paths")
+	reportPath := flag.String("report", "", "Write a compliance sign-off report to this file (HTML for .html, plain text otherwise)")
+	ruleReportPath := flag.String("rule-report", "", "Write a JSON array of the proposed/created deny rules and their status to this file when the run ends")
+	var workloadParamPairs repeatedList
+	flag.Var(&workloadParamPairs, "workload-param", "Extra workloads API filter as key=value, e.g. os_id=windows (repeatable; the value is passed as is, commas included); narrower filters mean fewer apps are evaluated")
+	flag.BoolVar(&includeUnlabeled, "include-unlabeled", false, "Analyze an env whose workloads have no app labels as one scope, denying the service for the whole env (providers = env label only) when it is unused")
+	hostnameRegex := flag.String("hostname-regex", "", "Only consider workloads whose hostname matches this regular expression")
+	flag.DurationVar(&shortWindow, "short-window", shortWindow, "Lookback of the first traffic query (e.g. 168h for 7 days)")
+	flag.DurationVar(&longWindow, "long-window", longWindow, "Lookback of the second query, run only when the short window had no flows (e.g. 4320h for 180 days); must be >= -short-window and within the PCE's traffic retention, or older flows are silently missing")
+	flag.BoolVar(&singleWindow, "single-window", false, "Run only the -long-window query per app, skipping the short-window pass (halves query volume)")
+	flag.DurationVar(&pollInterval, "poll-interval", pollInterval, "How often to poll an async traffic query for completion")
+	flag.DurationVar(&defaultPollTimeout, "poll-timeout", defaultPollTimeout, "Give up on an async traffic query after this long (the whole query, unlike the per-request -http-timeout)")
+	flag.BoolVar(&adaptivePollTimeout, "adaptive-poll-timeout", false, "Scale each query's poll timeout with service ports x lookback days instead of the fixed -poll-timeout")
+	flag.DurationVar(&pollTimeoutMin, "poll-timeout-min", pollTimeoutMin, "Lower bound of the adaptive poll timeout")
+	flag.DurationVar(&pollTimeoutMax, "poll-timeout-max", pollTimeoutMax, "Upper bound of the adaptive poll timeout")
+	scopeBy := flag.String("scope-by", "env", "Deprecated alias of -provider-dimensions without app, e.g. env,loc")
+	dimensions := flag.String("provider-dimensions", "env,app", "Label keys scoping both traffic queries and deny rule providers (env,app required; loc,role optional)")
 	flag.Parse()
+	runStarted := time.Now()
+
+	log.SetFlags(0)
+	log.SetOutput(levelWriter{level: "info"})
+	switch *logFormat {
+	case "text":
+	case "json":
+		logSinks[0].json = true
+	default:
+		log.Fatalf("Invalid -log-format: %q (allowed: text, json)", *logFormat)
+	}
+	switch *progressMode {
+	case "line":
+	case "bar":
+		// per-line logging stays whenever a bar can't be drawn cleanly
+		fi, err := os.Stderr.Stat()
+		progressBar = err == nil && fi.Mode()&os.ModeCharDevice != 0 && !verbose && *logFormat == "text"
+	default:
+		log.Fatalf("Invalid -progress: %q (allowed: line, bar)", *progressMode)
+	}
+	if *jsonLogFile != "" {
+		f, err := os.OpenFile(*jsonLogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open -json-logs-to-file: %v", err)
+		}
+		defer f.Close()
+		logSinks = append(logSinks, logSink{w: f, json: true})
+	}
+	if *outputDir != "" {
+		// one subdirectory per run, so successive runs never clobber each other
+		dir := filepath.Join(*outputDir, runID)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("Failed to create -output-dir run directory: %v", err)
+			return 1
+		}
+		f, err := os.Create(filepath.Join(dir, "run.log"))
+		if err != nil {
+			log.Printf("Failed to create log file in -output-dir: %v", err)
+			return 1
+		}
+		defer f.Close()
+		logSinks = append(logSinks, logSink{w: f})
+		if *ruleReportPath == "" {
+			*ruleReportPath = "rules.json"
+		}
+		if *csvPath == "" {
+			*csvPath = "decisions.csv"
+		}
+		for _, p := range []*string{reportPath, ruleReportPath, csvPath, outputJSON, summaryJSON} {
+			if *p != "" && !filepath.IsAbs(*p) {
+				*p = filepath.Join(dir, *p)
+			}
+		}
+		log.Printf("Writing run artifacts to %s", dir)
+	}
+	if *outputNDJSON {
+		ndjsonOut = &ndjsonWriter{w: os.Stdout}
+	}
+
+	if *pprofAddr != "" {
+		addr := localAddr(*pprofAddr)
+		go func() {
+			if err := http.ListenAndServe(addr, nil); err != nil {
+				log.Printf("pprof server stopped: %v", err)
+			}
+		}()
+		log.Printf("pprof available at http://%s/debug/pprof/", addr)
+	}
 
-	envs, err := getEnvs()
-	if err != nil {
-		log.Fatalf("Failed to load environments: %v", err)
+	var err error
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath, *profile)
+		if err != nil {
+			log.Printf("Failed to load config: %v", err)
+			return 1
+		}
+		// flags > environment > file, so a flag may supply a required field
+		if err := mergeConfig(cfg, conn).checkRequired(); err != nil {
+			log.Printf("Failed to load config: %s: %v (set it in the file, the environment or with a flag)", *configPath, err)
+			return 1
+		}
+		applyConfig(cfg)
+	} else if *profile != "" {
+		log.Printf("-profile requires -config")
+		return 1
+	} else {
+		applyConfig(envConfig())
+	}
+	applyConfig(conn)
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	for _, c := range connEnv {
+		switch {
+		case setFlags[c.field]:
+			connSources[c.field] = "flag -" + c.field
+		case os.Getenv(c.env) != "":
+			connSources[c.field] = "env " + c.env
+		case *configPath != "":
+			connSources[c.field] = "config"
+		default:
+			connSources[c.field] = "default"
+		}
+	}
+	if setFlags["concurrency"] {
+		queryConcurrency = *concurrency
+	}
+	if queryConcurrency < 1 {
+		log.Printf("Invalid -concurrency: %d (must be >= 1)", queryConcurrency)
+		return 1
+	}
+	if queryConcurrency > maxConcurrency {
+		log.Printf("Warning: concurrency %d capped at %d; the PCE limits concurrent async queries", queryConcurrency, maxConcurrency)
+		queryConcurrency = maxConcurrency
 	}
-	services, err := getRansomServices()
+	if *maxAsync < 1 {
+		log.Printf("Invalid -max-async: %d (must be >= 1)", *maxAsync)
+		return 1
+	}
+	asyncSem = make(chan struct{}, *maxAsync)
+	if setFlags["http-timeout"] {
+		if *httpTimeout <= 0 {
+			log.Printf("Invalid -http-timeout: %v (must be positive)", *httpTimeout)
+			return 1
+		}
+		httpClient.Timeout = *httpTimeout
+	}
+	t, err := newTransport(*insecure, *caBundle, *proxy)
 	if err != nil {
-		log.Fatalf("Failed to load ransomware services: %v", err)
+		log.Printf("Invalid transport settings: %v", err)
+		return 1
+	}
+	httpClient.Transport = t
+	if fqdn == "" || (setFlags["fqdn"] && conn.FQDN == "") {
+		log.Printf("Invalid -fqdn: PCE hostname must not be empty")
+		return 1
+	}
+	if err := validatePort(port); err != nil {
+		log.Printf("Invalid -port: %v", err)
+		return 1
+	}
+	redactRegister("host", fqdn)
+
+	policyPCE = &PCEClient{FQDN: fqdn, Port: port, Org: org, User: user, Key: key}
+	q := mergeConfig(Config{FQDN: fqdn, Port: port, Org: org, User: user, Key: key}, queryConn)
+	if err := validatePort(q.Port); err != nil {
+		log.Printf("Invalid -query-port: %v", err)
+		return 1
+	}
+	queryPCE = &PCEClient{FQDN: q.FQDN, Port: q.Port, Org: q.Org, User: q.User, Key: q.Key}
+	redactRegister("host", queryPCE.FQDN)
+	for _, k := range []string{policyPCE.Key, queryPCE.Key} {
+		if k != "" {
+			secrets = append(secrets, k)
+		}
+	}
+	vlog("Connection: fqdn %s (%s), port %s (%s), org %s (%s), user %s (%s), key [REDACTED] (%s)",
+		fqdn, connSources["fqdn"], port, connSources["port"], org, connSources["org"],
+		user, connSources["user"], connSources["key"])
+
+	if setFlags["scope-by"] {
+		if setFlags["provider-dimensions"] {
+			log.Printf("-scope-by and -provider-dimensions both set; use one")
+			return 1
+		}
+		if providerDimensions, err = parseScopeBy(*scopeBy); err != nil {
+			log.Printf("Invalid -scope-by: %v", err)
+			return 1
+		}
+		log.Printf("Warning: -scope-by is deprecated; use -provider-dimensions %s", strings.Join(providerDimensions, ","))
+	} else if providerDimensions, err = parseProviderDimensions(*dimensions); err != nil {
+		log.Printf("Invalid -provider-dimensions: %v", err)
+		return 1
+	}
+	if useWorkloadSubnets, err = parseWorkloadSubnets(*workloadSubnets); err != nil {
+		log.Printf("Invalid -use-workload-subnets: %v", err)
+		return 1
+	}
+	if workloadParams, err = parseWorkloadParams(workloadParamPairs); err != nil {
+		log.Printf("Invalid -workload-param: %v", err)
+		return 1
+	}
+	if *hostnameRegex != "" {
+		if hostnameFilter, err = regexp.Compile(*hostnameRegex); err != nil {
+			log.Printf("Invalid -hostname-regex: %v", err)
+			return 1
+		}
+	}
+	if !regexp.MustCompile(`^v[0-9]+$`).MatchString(apiVersion) {
+		log.Printf("Invalid -api-version %q: want a version like v2", apiVersion)
+		return 1
+	}
+	if setFlags["rule-description"] && setFlags["rule-description-template"] {
+		log.Printf("-rule-description and -rule-description-template both set; use one")
+		return 1
+	}
+	if len(ruleTag) > maxRuleTagLen {
+		log.Printf("Invalid -rule-tag: %d characters, at most %d fit in external_data_reference", len(ruleTag), maxRuleTagLen)
+		return 1
+	}
+	if *createConcurrency < 1 {
+		log.Printf("Invalid -create-concurrency %d: must be at least 1", *createConcurrency)
+		return 1
+	}
+	if *createConcurrency > maxConcurrency {
+		log.Printf("Warning: -create-concurrency %d capped at %d", *createConcurrency, maxConcurrency)
+		*createConcurrency = maxConcurrency
+	}
+	if *cacheMaxAge < 0 {
+		log.Printf("Invalid -cache-max-age %s: must be 0 or positive", *cacheMaxAge)
+		return 1
+	}
+	if *limit < 0 {
+		log.Printf("Invalid -limit %d: must be 0 or positive", *limit)
+		return 1
+	}
+	if shortWindow <= 0 || longWindow <= 0 {
+		log.Printf("Invalid lookback windows: -short-window and -long-window must be positive")
+		return 1
+	}
+	if longWindow < shortWindow {
+		log.Printf("Invalid -long-window %s: must be at least -short-window %s", formatWindow(longWindow), formatWindow(shortWindow))
+		return 1
+	}
+	if pollInterval <= 0 || pollInterval >= defaultPollTimeout {
+		log.Printf("Invalid -poll-interval %s: must be positive and below -poll-timeout %s", pollInterval, defaultPollTimeout)
+		return 1
+	}
+	if adaptivePollTimeout && (pollTimeoutMin <= 0 || pollTimeoutMax < pollTimeoutMin) {
+		log.Printf("Invalid poll timeout bounds: need 0 < -poll-timeout-min <= -poll-timeout-max")
+		return 1
+	}
+	if adaptivePollTimeout && pollInterval >= pollTimeoutMin {
+		log.Printf("Invalid -poll-interval %s: must be below -poll-timeout-min %s", pollInterval, pollTimeoutMin)
+		return 1
+	}
+	if sampleFlows < 0 {
+		log.Printf("Invalid -sample-flows: %d (must be >= 0)", sampleFlows)
+		return 1
+	}
+	if *saveQueriesFlag && *dryRun {
+		// a dry run never writes to the PCE
+		log.Printf("-save-queries adds saved queries to the PCE and cannot be combined with -dry-run")
+		return 1
+	}
+	if *order != "name" && *order != "largest-env-first" {
+		log.Printf("Invalid -order: %q (allowed: name, largest-env-first)", *order)
+		return 1
+	}
+	if *queryMode != "per-app" && *queryMode != "per-service" {
+		log.Printf("Invalid -query-mode: %q (allowed: per-app, per-service)", *queryMode)
+		return 1
+	}
+	switch ruleDirection {
+	case "ingress":
+	case "egress", "both":
+		if *queryMode == "per-service" {
+			// per-service results are attributed by destination workload only
+			log.Printf("Invalid -direction %s: -query-mode per-service supports only ingress", ruleDirection)
+			return 1
+		}
+	default:
+		log.Printf("Invalid -direction: %q (allowed: ingress, egress, both)", ruleDirection)
+		return 1
+	}
+	if *maxDenyFraction < 0 || *maxDenyFraction > 1 {
+		log.Printf("Invalid -max-deny-fraction: %v (must be between 0 and 1)", *maxDenyFraction)
+		return 1
+	}
+	if *setupConcurrency < 1 {
+		log.Printf("Invalid -setup-concurrency: %d (must be >= 1)", *setupConcurrency)
+		return 1
+	}
+	if retryAttempts < 1 {
+		log.Printf("Invalid -retries: %d (must be >= 1)", retryAttempts)
+		return 1
+	}
+	if retryBackoffBase <= 0 {
+		log.Printf("Invalid -backoff-base: must be positive")
+		return 1
+	}
+	if retryMaxBackoff <= 0 {
+		log.Printf("Invalid -retry-max-backoff: must be positive")
+		return 1
+	}
+	if retryJitter < 0 || retryJitter > 1 {
+		log.Printf("Invalid -retry-jitter: %v (must be between 0 and 1)", retryJitter)
+		return 1
+	}
+	for _, cidr := range excludeSourceCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			log.Printf("Invalid -exclude-source-cidr %q: %v", cidr, err)
+			return 1
+		}
+		excludedSourceCIDRs = append(excludedSourceCIDRs, cidr)
+	}
+	if resolveSourcesAs, err = parseResolveLabelsAs(*resolveSources); err != nil {
+		log.Printf("Invalid -resolve-sources-as: %v", err)
+		return 1
+	}
+	if resolveDestinationsAs, err = parseResolveLabelsAs(*resolveDestinations); err != nil {
+		log.Printf("Invalid -resolve-destinations-as: %v", err)
+		return 1
+	}
+	if policyDecisions, err = parseDecisions(*policyDecisionsFlag, allowedPolicyDecisions); err != nil {
+		log.Printf("Invalid -policy-decisions: %v", err)
+		return 1
+	}
+	if boundaryDecisions, err = parseDecisions(*boundaryDecisionsFlag, allowedBoundaryDecisions); err != nil {
+		log.Printf("Invalid -boundary-decisions: %v", err)
+		return 1
+	}
+	if len(policyDecisions) > 0 || len(boundaryDecisions) > 0 {
+		log.Printf("Warning: only flows with policy decisions %v / boundary decisions %v count as traffic; other flows will not prevent a deny rule",
+			policyDecisions, boundaryDecisions)
+	}
+
+	if err := policyPCE.ping(); err != nil {
+		log.Printf("Pre-flight check failed: %v", err)
+		return 1
+	}
+	if *queryPCE != *policyPCE {
+		if err := queryPCE.ping(); err != nil {
+			log.Printf("Pre-flight check failed: %v", err)
+			return 1
+		}
+		log.Printf("Traffic queries go to %s, policy changes to %s", queryPCE, policyPCE)
 	}
 
-	friendly := time.Now().Format("Jan 02, 2006 15:04:05")
-	rulesetName := fmt.Sprintf("Auto Deny Rules - %s", friendly)
-	rulesetHref, err := createRuleset(rulesetName)
+	if *describe {
+		if len(envValues) > 1 {
+			log.Printf("-describe-query takes a single -env")
+			return 1
+		}
+		envValue := ""
+		if len(envValues) == 1 {
+			envValue = envValues[0]
+		}
+		if len(appValues) > 1 {
+			log.Printf("-describe-query takes a single -app")
+			return 1
+		}
+		appValue := ""
+		if len(appValues) == 1 {
+			appValue = appValues[0]
+		}
+		if len(serviceNames) > 1 {
+			log.Printf("-describe-query takes a single -service")
+			return 1
+		}
+		serviceName := ""
+		if len(serviceNames) == 1 {
+			serviceName = serviceNames[0]
+		}
+		if err := describeQuery(envValue, appValue, serviceName, *excludeBroadcast, *excludeMulticast); err != nil {
+			log.Printf("Failed to describe query: %v", err)
+			return 1
+		}
+		return 0
+	}
+
+	envs, err := getEnvs()
+	if err != nil {
+		log.Printf("Failed to load environments: %v", err)
+		return 1
+	}
+	for _, dim := range providerDimensions[2:] {
+		found, err := hasLabels(dim)
+		if err != nil {
+			log.Printf("Failed to look up %s labels: %v", dim, err)
+			return 1
+		}
+		if !found {
+			log.Printf("Warning: no %s labels in the org; every workload will be skipped for lacking one", dim)
+		}
+	}
+	if len(envHrefs) > 0 {
+		if envs, err = pinEnvs(envs, envHrefs); err != nil {
+			log.Printf("Invalid -env-href: %v", err)
+			return 1
+		}
+		log.Printf("Using %d pinned env label(s)", len(envs))
+		if len(envValues) > 0 {
+			log.Printf("-env ignored because -env-href is set")
+		}
+	} else if len(envValues) > 0 {
+		if envs, err = filterEnvs(envs, envValues); err != nil {
+			log.Printf("Invalid -env: %v", err)
+			return 1
+		}
+		log.Printf("Analyzing %d env(s): %s", len(envs), strings.Join(labelValues(envs), ", "))
+	}
+	services, err := loadServices()
 	if err != nil {
-		log.Fatalf("Failed to create rule set: %v", err)
+		log.Printf("Failed to load services: %v", err)
+		return 1
+	}
+	if servicesFile != "" {
+		log.Printf("Using %d service(s) from %s", len(services), servicesFile)
+	}
+	if len(serviceNames) > 0 {
+		if services, err = filterServices(services, serviceNames); err != nil {
+			log.Printf("Invalid -service: %v", err)
+			return 1
+		}
 	}
-	log.Printf("Created Auto Deny Rules rule set %s", rulesetHref)
 
-	type envInfo struct {
-		env  Label
-		apps []Label
+	var rulesetHref string
+	if *existingRuleset != "" {
+		if !strings.Contains(*existingRuleset, "/sec_policy/draft/rule_sets/") {
+			log.Printf("Invalid -existing-ruleset %q: want a draft rule set href like /orgs/1/sec_policy/draft/rule_sets/42", *existingRuleset)
+			return 1
+		}
+		name, err := getRulesetName(*existingRuleset)
+		if err != nil {
+			log.Printf("Invalid -existing-ruleset %s: %v", *existingRuleset, err)
+			return 1
+		}
+		rulesetHref = *existingRuleset
+		log.Printf("Adding deny rules to existing rule set %q (%s)", name, rulesetHref)
+		if *dryRun {
+			log.Println("Dry run: no deny rules will be created.")
+		}
+	} else if *dryRun {
+		log.Println("Dry run: no rule set or deny rules will be created.")
 	}
+
+	setups := setupEnvs(envs, *setupConcurrency)
+
 	var envInfos []envInfo
-	for _, env := range envs {
-		apps, err := getWorkloadsForEnv(env)
+	var skippedEnvs []skippedEnv
+	for i, env := range envs {
+		apps, err := setups[i].apps, setups[i].err
 		if err != nil {
-			vlog("Failed to get workloads for env %s: %v", env.Value, err)
+			if !*continueOnEnvError {
+				log.Printf("Setup failed for env %s: %v", env.Value, err)
+				return 1
+			}
+			log.Printf("Skipping env %s: %v", env.Value, err)
+			skippedEnvs = append(skippedEnvs, skippedEnv{Env: env.Value, Href: env.Href, Reason: err.Error()})
 			continue
 		}
+		if len(appValues) > 0 {
+			var missing []string
+			apps, missing = filterApps(apps, appValues)
+			if len(missing) > 0 {
+				log.Printf("Warning: env %s has no workloads for -app %s", env.Value, strings.Join(missing, ", "))
+			}
+		}
 		if len(apps) == 0 {
 			continue
 		}
@@ -421,107 +4379,694 @@ func main() {
 	for _, ei := range envInfos {
 		totalQueries += int64(len(services) * len(ei.apps))
 	}
+	if *limit > 0 && totalQueries > int64(*limit) {
+		log.Printf("Limiting the run to %d of %d traffic queries (-limit)", *limit, totalQueries)
+		totalQueries = int64(*limit)
+	}
 	if totalQueries == 0 {
 		log.Println("No queries to run - exiting.")
-		return
+		emitResult(runResult{RulesetHref: rulesetHref, DryRun: *dryRun})
+		return 0
 	}
 	log.Printf("Total traffic queries to execute: %d", totalQueries)
+	if *saveQueriesFlag {
+		log.Printf("Saving queries for run %s: up to %d saved query object(s) will be added to the PCE",
+			runID, 2*totalQueries)
+	}
 
-	var wg sync.WaitGroup
-	sem := make(chan struct{}, 2) // max 2 concurrent queries
+	var cache *resultCache
+	if *cachePath != "" {
+		if cache, err = openResultCache(*cachePath, *cacheMaxAge); err != nil {
+			log.Printf("Failed to open -cache: %v", err)
+			return 1
+		}
+		defer cache.Close()
+		log.Printf("Resuming with %d cached query result(s) from %s", len(cache.entries), *cachePath)
+	}
+
+	sem := make(chan struct{}, queryConcurrency)
 	var denyRules []denyRuleInfo
 	var denyRulesMu sync.Mutex
 
-	targetIPListName := "Any (0.0.0.0/0 and ::/0)"
-	ipListHref, err := getIPListHref(targetIPListName)
-	if err != nil {
-		log.Fatalf("Failed to locate IP-list %q: %v", targetIPListName, err)
+	// per-service sub-semaphores, acquired before the global one so a
+	// throttled service never holds global slots while it waits
+	serviceSems := make(map[string]chan struct{})
+	for name, n := range serviceConcurrency {
+		serviceSems[name] = make(chan struct{}, n)
+		vlog("Service %s limited to %d concurrent queries", name, n)
+	}
+
+	if len(ipListNames) == 0 {
+		ipListNames = stringList{"Any (0.0.0.0/0 and ::/0)"}
+	}
+	var ipListHrefs []string
+	for _, name := range ipListNames {
+		href, err := getIPListHref(name)
+		if err != nil {
+			if !*continueOnEnvError {
+				log.Printf("Failed to locate IP-list %q: %v", name, err)
+				return 1
+			}
+			log.Printf("Warning: skipping IP-list %q: %v", name, err)
+			continue
+		}
+		if containsString(ipListHrefs, href) {
+			continue
+		}
+		log.Printf("Using IP-list %q href: %s", name, href)
+		ipListHrefs = append(ipListHrefs, href)
+	}
+	if len(ipListHrefs) == 0 {
+		log.Printf("None of the -ip-list names resolved: %s", strings.Join(ipListNames, ", "))
+		return 1
+	}
+
+	for _, name := range labelGroupNames {
+		g, err := getLabelGroup(name)
+		if err != nil {
+			log.Printf("Failed to locate label group %q: %v", name, err)
+			return 1
+		}
+		if _, ok := findLabelGroup(g.Href); ok {
+			continue
+		}
+		log.Printf("Using label group %q href: %s (%d app label(s))", name, g.Href, len(g.members))
+		labelGroups = append(labelGroups, g)
+	}
+
+	var unresolved []string
+	for _, name := range excludeSourceIPLists {
+		href, err := getIPListHref(name)
+		if err != nil {
+			unresolved = append(unresolved, fmt.Sprintf("%q (%v)", name, err))
+			continue
+		}
+		vlog("Excluding source IP-list %q (%s)", name, href)
+		excludedSourceIPLists = append(excludedSourceIPLists, href)
+	}
+	if len(unresolved) > 0 {
+		log.Printf("Failed to resolve -exclude-source-ip-lists: %s", strings.Join(unresolved, "; "))
+		return 1
+	}
+
+	if err := orderWork(envInfos, services, *order); err != nil {
+		log.Printf("Invalid -order: %v", err)
+		return 1
 	}
-	log.Printf("Using the Any IP-list href: %s", ipListHref)
 
-	var doneQueries int64
+	var combos []queryCombo
 	for _, ei := range envInfos {
 		for _, service := range services {
-			var appsNoTraffic []Label
-			var appsMu sync.Mutex
-
-			for _, app := range ei.apps {
-				wg.Add(1)
-				sem <- struct{}{}
-				go func(a Label) {
-					defer wg.Done()
-					defer func() { <-sem }()
-
-					ok, err := submitTrafficQuery(
-						ei.env.Href, a.Href, service,
-						*excludeBroadcast, *excludeMulticast,
-					)
-					if err != nil {
-						log.Printf("[Query] Env:%s  App:%s  Service:%s  →  error: %v",
-							ei.env.Value, a.Value, service.Name, err)
-					} else if ok { // no traffic found
-						appsMu.Lock()
-						appsNoTraffic = append(appsNoTraffic, a)
-						appsMu.Unlock()
-					}
+			combos = append(combos, queryCombo{ei: ei, service: service})
+		}
+	}
+	if *runtimeBudget > 0 {
+		// largest coverage first, so the budget goes to the most apps
+		sort.SliceStable(combos, func(i, j int) bool {
+			return len(combos[i].ei.apps) > len(combos[j].ei.apps)
+		})
+	}
 
-					// update and print query progress (always shown)
-					atomic.AddInt64(&doneQueries, 1)
-					logQueryProgress(ei.env, a, service,
-						atomic.LoadInt64(&doneQueries), totalQueries)
-				}(app)
+	runStart := time.Now()
+	var doneQueries, queryNanos, timedQueries, inconclusiveQueries int64
+	var erroredQueries, noTrafficQueries, failedDenyRules int64
+	var outcomes []queryOutcome
+	var outcomesMu sync.Mutex
+	var skippedCombos []queryCombo
+	var blockedRules []blockedRule
+	var launched int
+
+	if *metricsAddr != "" {
+		srv := &http.Server{Addr: localAddr(*metricsAddr), Handler: metricsMux([]metric{
+			{"auto_deny_rules_queries_total", "Traffic queries planned for this run.", "gauge", func() int64 { return totalQueries }},
+			{"auto_deny_rules_queries_done", "Traffic queries finished.", "counter", func() int64 { return atomic.LoadInt64(&doneQueries) }},
+			{"auto_deny_rules_queries_errored", "Traffic queries that failed.", "counter", func() int64 { return atomic.LoadInt64(&erroredQueries) }},
+			{"auto_deny_rules_rules_created", "Deny rules created.", "counter", func() int64 { return atomic.LoadInt64(&doneDenyRules) }},
+			{"auto_deny_rules_rules_failed", "Deny rules that failed to create.", "counter", func() int64 { return atomic.LoadInt64(&failedDenyRules) }},
+		})}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Printf("Metrics server stopped: %v", err)
+			}
+		}()
+		defer func() {
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdownCtx)
+		}()
+		log.Printf("Metrics available at http://%s/metrics", srv.Addr)
+	}
+
+	// SIGINT/SIGTERM stop new queries and abort in-flight polls; outside the
+	// fan-out the default handling (exit) still applies
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	// -fail-fast cancels with the first query error as the cause
+	ctx, abort := context.WithCancelCause(sigCtx)
+	defer abort(nil)
+	if *runTimeout > 0 {
+		// -run-timeout counts from startup; rule creation still runs after it
+		var cancelRun context.CancelFunc
+		ctx, cancelRun = context.WithDeadlineCause(ctx, runStarted.Add(*runTimeout), errRunTimeout)
+		defer cancelRun()
+	}
+	for _, combo := range combos {
+		if ctx.Err() != nil {
+			break
+		}
+		ei, service := combo.ei, combo.service
+		if *runtimeBudget > 0 {
+			perQuery := *estimatedQueryTime
+			if n := atomic.LoadInt64(&timedQueries); n > 0 {
+				perQuery = time.Duration(atomic.LoadInt64(&queryNanos) / n)
+			}
+			estimate := estimateComboTime(len(ei.apps), cap(sem), perQuery)
+			if time.Since(runStart)+estimate > *runtimeBudget*95/100 {
+				vlog("Budget: skipping env %s service %s (estimated %s)",
+					ei.env.Value, service.Name, estimate.Round(time.Second))
+				skippedCombos = append(skippedCombos, combo)
+				continue
+			}
+		}
+
+		// -limit: only the first apps up to the cap get queried
+		apps := ei.apps
+		if *limit > 0 {
+			remaining := *limit - launched
+			if remaining <= 0 {
+				break
 			}
+			if len(apps) > remaining {
+				apps = apps[:remaining]
+			}
+		}
+		launched += len(apps)
 
-			// wait for all apps of this service to finish before moving on
-			wg.Wait()
+		var appsNoTraffic []appScope
+		var appsMu sync.Mutex
+		var wg sync.WaitGroup
 
-			if len(appsNoTraffic) > 0 {
-				denyRulesMu.Lock()
-				denyRules = append(denyRules, denyRuleInfo{
-					env:     ei.env,
-					service: service,
-					apps:    appsNoTraffic,
+		svcSem := serviceSems[service.Name]
+		settings := querySettingsKey(service, *excludeBroadcast, *excludeMulticast)
+		query := func(a appScope) (bool, []windowResult, error) {
+			return submitTrafficQuery(ctx, ei.env, a, service, *excludeBroadcast, *excludeMulticast)
+		}
+		if *queryMode == "per-service" {
+			if !acquire(ctx, svcSem) {
+				break
+			}
+			if !acquire(ctx, sem) {
+				release(svcSem)
+				break
+			}
+			var uncached []appScope
+			for _, a := range apps {
+				if _, hit := cache.get(cacheKey(ei.env, a, service, settings)); !hit {
+					uncached = append(uncached, a)
+				}
+			}
+			var batch map[string]appQueryResult
+			var berr error
+			if len(uncached) > 0 {
+				batch, berr = submitServiceQuery(ctx, ei.env, uncached, service, *excludeBroadcast, *excludeMulticast)
+			}
+			release(sem)
+			release(svcSem)
+			if errors.Is(berr, errBatchTruncated) || errors.Is(berr, errBatchUnattributed) {
+				log.Printf("Env %s service %s: %v; falling back to per-app queries", ei.env.Value, service.Name, berr)
+			} else {
+				query = func(a appScope) (bool, []windowResult, error) {
+					if berr != nil {
+						return false, nil, berr
+					}
+					r := batch[labelsKey(scopeLabels(ei.env, a))]
+					return r.ok, r.windows, nil
+				}
+			}
+		}
+		for _, app := range apps {
+			if ctx.Err() != nil {
+				break
+			}
+			// an interrupt must not wait for a free slot
+			if !acquire(ctx, svcSem) {
+				break
+			}
+			if !acquire(ctx, sem) {
+				release(svcSem)
+				break
+			}
+			wg.Add(1)
+			go func(a appScope) {
+				defer wg.Done()
+				defer func() {
+					release(sem)
+					release(svcSem)
+				}()
+				// one broken query must not take the run down or leave
+				// wg.Wait hanging; it counts as an errored query
+				defer guardQuery(func(r interface{}) {
+					atomic.AddInt64(&erroredQueries, 1)
+					atomic.AddInt64(&doneQueries, 1)
+					log.Printf("[Query] Env:%s  App:%s  Service:%s  →  panic: %v",
+						ei.env.Value, a.app.Value, service.Name, r)
+					outcome := queryOutcome{Env: ei.env, App: a.app, Extras: a.extras, Service: service,
+						Decision: decisionError, Reason: fmt.Sprint("panic: ", r)}
+					outcomesMu.Lock()
+					outcomes = append(outcomes, outcome)
+					outcomesMu.Unlock()
+					if ndjsonOut != nil {
+						if werr := ndjsonOut.Write(newNDJSONOutcome(outcome)); werr != nil {
+							log.Printf("Failed to write NDJSON outcome: %v", werr)
+						}
+					}
 				})
-				denyRulesMu.Unlock()
+
+				if *saveQueriesFlag {
+					if serr := saveQueries(ei.env, a, service, *excludeBroadcast, *excludeMulticast); serr != nil {
+						log.Printf("[Query] Env:%s  App:%s  Service:%s  →  failed to save queries: %v",
+							ei.env.Value, a.app.Value, service.Name, serr)
+					}
+				}
+				var ok bool
+				var windows []windowResult
+				var err error
+				key := cacheKey(ei.env, a, service, settings)
+				if ce, hit := cache.get(key); hit {
+					ok, windows = ce.NoTraffic, ce.Windows
+					vlog("[Query] Env:%s  App:%s  Service:%s  →  cached result", ei.env.Value, a.app.Value, service.Name)
+				} else {
+					queryStart := time.Now()
+					ok, windows, err = query(a)
+					atomic.AddInt64(&queryNanos, int64(time.Since(queryStart)))
+					atomic.AddInt64(&timedQueries, 1)
+					if err == nil {
+						if cerr := cache.put(cacheEntry{Key: key, NoTraffic: ok, Windows: windows}); cerr != nil {
+							log.Printf("Failed to write -cache entry: %v", cerr)
+						}
+					}
+				}
+				outcome := queryOutcome{Env: ei.env, App: a.app, Extras: a.extras, Service: service, Windows: windows}
+				if err == nil && ok {
+					// zero flows is only meaningful if the scope still exists
+					if verr := verifyScopeLabels(scopeLabels(ei.env, a)); verr != nil {
+						log.Printf("[Query] Env:%s  App:%s  Service:%s  →  warning: zero flows but %v",
+							ei.env.Value, a.app.Value, service.Name, verr)
+						if strict {
+							ok = false
+							atomic.AddInt64(&inconclusiveQueries, 1)
+							outcome.Decision, outcome.Reason = decisionInconclusive, verr.Error()
+						}
+					}
+				}
+				if err == nil && ok && *requireBaseline {
+					// absent telemetry looks exactly like an unused service
+					baseline, berr := hasBaselineTraffic(ctx, ei.env, a, *excludeBroadcast, *excludeMulticast)
+					if berr != nil || !baseline {
+						ok = false
+						atomic.AddInt64(&inconclusiveQueries, 1)
+						reason := fmt.Sprintf("no flows on any service in the last %s", formatWindow(longWindow))
+						if berr != nil {
+							reason = berr.Error()
+						}
+						outcome.Decision, outcome.Reason = decisionInconclusive, reason
+						log.Printf("[Query] Env:%s  App:%s  Service:%s  →  inconclusive: %s",
+							ei.env.Value, a.app.Value, service.Name, reason)
+					}
+				}
+				if err != nil {
+					outcome.Decision, outcome.Reason = decisionError, err.Error()
+					atomic.AddInt64(&erroredQueries, 1)
+					if *failFast && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+						abort(fmt.Errorf("env %s app %s service %s: %w", ei.env.Value, a.app.Value, service.Name, err))
+					}
+					log.Printf("[Query] Env:%s  App:%s  Service:%s  →  error: %v",
+						ei.env.Value, a.app.Value, service.Name, err)
+				} else if ok { // no traffic found
+					outcome.Decision = decisionDeny
+					atomic.AddInt64(&noTrafficQueries, 1)
+					appsMu.Lock()
+					appsNoTraffic = append(appsNoTraffic, a)
+					appsMu.Unlock()
+				} else if outcome.Decision == "" {
+					outcome.Decision = decisionTraffic
+				}
+				outcomesMu.Lock()
+				outcomes = append(outcomes, outcome)
+				outcomesMu.Unlock()
+				if ndjsonOut != nil {
+					if werr := ndjsonOut.Write(newNDJSONOutcome(outcome)); werr != nil {
+						log.Printf("Failed to write NDJSON outcome: %v", werr)
+					}
+				}
+
+				// update and print query progress (always shown)
+				atomic.AddInt64(&doneQueries, 1)
+				logQueryProgress(ei.env, a, service,
+					atomic.LoadInt64(&doneQueries), totalQueries)
+			}(app)
+		}
+
+		// wait for all apps of this service to finish before moving on
+		wg.Wait()
+
+		if len(appsNoTraffic) > 0 {
+			var rules []denyRuleInfo
+			for _, dr := range groupByExtras(ei.env, service, appsNoTraffic) {
+				rules = append(rules, withDirections(splitRule(dr, *maxAppsPerRule))...)
+			}
+			fraction := float64(len(appsNoTraffic)) / float64(len(apps))
+			denyRulesMu.Lock()
+			if *maxDenyFraction > 0 && fraction > *maxDenyFraction {
+				// denying most of an env is more likely missing telemetry or bad labels
+				log.Printf("Warning: env %s service %s: %d of %d app(s) (%.0f%%) would be denied, above -max-deny-fraction %.2f; not creating these rules, investigate",
+					ei.env.Value, service.Name, len(appsNoTraffic), len(apps), fraction*100, *maxDenyFraction)
+				for _, dr := range rules {
+					blockedRules = append(blockedRules, blockedRule{dr, fraction})
+				}
+			} else {
+				denyRules = append(denyRules, rules...)
+			}
+			denyRulesMu.Unlock()
+		}
+	}
+	finishProgressBar()
+	interrupted := ctx.Err() != nil
+	cause := context.Cause(ctx)
+	stop()
+	timedOut := interrupted && sigCtx.Err() == nil && errors.Is(cause, errRunTimeout)
+	if timedOut {
+		log.Printf("Run cut short by -run-timeout %s: %d of %d queries completed; creating deny rules for the completed ones",
+			*runTimeout, atomic.LoadInt64(&doneQueries), totalQueries)
+		interrupted = false
+	}
+	if interrupted && sigCtx.Err() == nil {
+		emitResult(runResult{
+			RulesetHref:  rulesetHref,
+			QueriesTotal: totalQueries,
+			QueriesDone:  atomic.LoadInt64(&doneQueries),
+			DryRun:       *dryRun,
+		})
+		log.Printf("Aborted by -fail-fast after %d of %d queries; no deny rules created: %v",
+			atomic.LoadInt64(&doneQueries), totalQueries, cause)
+		return 1
+	}
+	if interrupted {
+		log.Printf("Interrupted: %d of %d queries completed; no deny rules will be created",
+			atomic.LoadInt64(&doneQueries), totalQueries)
+		emitResult(runResult{
+			RulesetHref:  rulesetHref,
+			QueriesTotal: totalQueries,
+			QueriesDone:  atomic.LoadInt64(&doneQueries),
+			DryRun:       *dryRun,
+		})
+		return 130
+	}
+
+	if *runtimeBudget > 0 {
+		log.Printf("Budget: analyzed %d of %d env/service combination(s) in %s",
+			len(combos)-len(skippedCombos), len(combos), time.Since(runStart).Round(time.Second))
+		for _, c := range skippedCombos {
+			log.Printf("Budget: not analyzed env %s service %s (apps: %d)",
+				c.ei.env.Value, c.service.Name, len(c.ei.apps))
+		}
+	}
+
+	if *reportPath != "" {
+		if err := writeReport(*reportPath, outcomes); err != nil {
+			log.Printf("Failed to write -report: %v", err)
+		} else {
+			log.Printf("Wrote compliance report to %s", *reportPath)
+		}
+	}
+
+	if *csvPath != "" {
+		blocked := make(map[string]bool)
+		for _, b := range blockedRules {
+			blocked[b.dr.env.Href+" "+b.dr.service.Href] = true
+		}
+		if err := writeCSV(*csvPath, outcomes, blocked); err != nil {
+			log.Printf("Failed to write -csv: %v", err)
+		} else {
+			log.Printf("Wrote deny candidates CSV to %s", *csvPath)
+		}
+	}
+
+	var plan *jsonArrayWriter
+	if *outputJSON != "" {
+		if plan, err = newJSONArrayWriter(*outputJSON); err != nil {
+			log.Printf("Failed to open -output-json file: %v", err)
+			return 1
+		}
+	}
+
+	// every rule outcome goes to -output-json as it happens and to
+	// -rule-report at the end
+	ruleEntries := []planEntry{}
+	recordRule := func(entry planEntry) {
+		ruleEntries = append(ruleEntries, entry)
+		if plan == nil {
+			return
+		}
+		if werr := plan.Write(entry); werr != nil {
+			log.Printf("Failed to write -output-json entry: %v", werr)
+		}
+	}
+
+	for _, b := range blockedRules {
+		entry := newPlanEntry(b.dr, ipListHrefs, "skipped", nil)
+		entry.Reason = fmt.Sprintf("%.0f%% of apps would be denied, above -max-deny-fraction %.2f", b.fraction*100, *maxDenyFraction)
+		recordRule(entry)
+	}
+
+	// skip rules the org's deny policy already has, so re-runs don't
+	// create duplicates
+	var existingRules int
+	if len(denyRules) > 0 {
+		if rules, err := getOrgDenyRules(); err != nil {
+			log.Printf("Warning: could not list existing deny rules, duplicates are not skipped: %v", err)
+		} else {
+			index := denyRuleIndex(rules)
+			fresh := denyRules[:0]
+			for _, dr := range denyRules {
+				ref := dr.reference(ipListHrefs)
+				href, ok := index[ref]
+				if !ok {
+					fresh = append(fresh, dr)
+					continue
+				}
+				existingRules++
+				vlog("Skipping deny rule for env %s service %s apps [%s]: already exists as %s",
+					dr.env.Value, dr.service.Name, strings.Join(labelValues(dr.apps), ", "), href)
+				entry := newPlanEntry(dr, ipListHrefs, "skipped", nil)
+				entry.Reason = "matching deny rule already exists: " + href
+				recordRule(entry)
+			}
+			denyRules = fresh
+			if existingRules > 0 {
+				log.Printf("Skipping %d deny rule(s) that already exist", existingRules)
 			}
 		}
 	}
 
+	for i := 0; i < *sampleOutput && i < len(denyRules); i++ {
+		printRulePreview(i+1, denyRules[i], ipListHrefs)
+	}
+
 	// Create deny rules in the single rule-set - with progress tracking
+	exitCode := 0
+	var createdRuleset bool
+	var ruleHrefs, createdRefs []string
+	var createdRules []denyRuleInfo
 	totalDenyRules = int64(len(denyRules))
 	if totalDenyRules == 0 {
 		log.Println("No deny rules needed - skipping rule creation.")
+	} else if *dryRun {
+		apps := 0
+		combos := make(map[string]bool)
+		for _, dr := range denyRules {
+			apps += len(dr.apps)
+			combos[dr.env.Href+" "+dr.service.Href] = true
+			_, err := denyRulePayload(dr, ipListHrefs)
+			if err != nil {
+				log.Printf("Dry run: deny rule for env %s service %s would fail: %v", dr.env.Value, dr.service.Name, err)
+			} else {
+				peer := "from"
+				if dr.egress {
+					peer = "to"
+				}
+				log.Printf("Dry run: would deny %s env %s service %s apps [%s] %s ip_list(s) %s",
+					dr.direction(), dr.env.Value, dr.service.Name, strings.Join(labelValues(dr.apps), ", "), peer, strings.Join(ipListHrefs, ", "))
+			}
+			recordRule(newPlanEntry(dr, ipListHrefs, "dry-run", err))
+		}
+		log.Printf("Dry run: %d deny rule(s) would be created covering %d app(s) in %d env/service combination(s); nothing was changed.",
+			totalDenyRules, apps, len(combos))
+	} else if *interactive && !*assumeYes && !confirmCreate(denyRules, ipListHrefs) {
+		log.Println("Deny rule creation not confirmed - nothing was changed.")
+		for _, dr := range denyRules {
+			entry := newPlanEntry(dr, ipListHrefs, "skipped", nil)
+			entry.Reason = "creation not confirmed"
+			recordRule(entry)
+		}
 	} else {
 		log.Printf("Creating %d deny rule(s)...", totalDenyRules)
-		for _, dr := range denyRules {
-			if err := createDenyRule(rulesetHref, dr.service.Href, dr.apps, dr.env, ipListHref); err != nil {
-				log.Printf("Failed to create deny rule for env %s service %s: %v",
-					dr.env.Value, dr.service.Name, err)
+		// the rule set only exists once there is something to put in it, but
+		// is named for when the run started
+		var rulesetErr error
+		if rulesetHref == "" {
+			rulesetName := fmt.Sprintf("Auto Deny Rules - %s", runStarted.Format("Jan 02, 2006 15:04:05"))
+			if rulesetHref, rulesetErr = createRuleset(rulesetName, *rulesetDescription); rulesetErr != nil {
+				log.Printf("Failed to create rule set: %v", rulesetErr)
+				rulesetErr = fmt.Errorf("no rule set: %w", rulesetErr)
+				if !*continueOnEnvError {
+					// the outputs are still written, but the run fails
+					exitCode = 1
+				}
 			} else {
-				// Combined log line
-				atomic.AddInt64(&doneDenyRules, 1)
-				percent := float64(atomic.LoadInt64(&doneDenyRules)) / float64(totalDenyRules) * 100
-				log.Printf("Created deny rule for env %s service %s (apps: %d) – Progress: %.1f%% (%d/%d)",
-					dr.env.Value, dr.service.Name, len(dr.apps),
-					percent, atomic.LoadInt64(&doneDenyRules), totalDenyRules)
-				// End combined line
+				createdRuleset = true
+				log.Printf("Created Auto Deny Rules rule set %s", rulesetHref)
+			}
+		}
+		// outcomes reach -output-json as each rule finishes, so a crash
+		// mid-creation still leaves the created rules on record
+		record := func(dr denyRuleInfo, ruleHref string, err error) {
+			recordRule(newPlanEntry(dr, ipListHrefs, "created", err))
+			if err != nil {
+				atomic.AddInt64(&failedDenyRules, 1)
+				return
+			}
+			ruleHrefs = append(ruleHrefs, ruleHref)
+			createdRefs = append(createdRefs,
+				externalReference(dr.reference(ipListHrefs)))
+			createdRules = append(createdRules, dr)
+		}
+		if rulesetErr != nil {
+			for _, dr := range denyRules {
+				log.Printf("Failed to create deny rule for env %s service %s: %v",
+					dr.env.Value, dr.service.Name, rulesetErr)
+				record(dr, "", rulesetErr)
+			}
+		} else {
+			createDenyRules(rulesetHref, denyRules, ipListHrefs, *createConcurrency, record)
+		}
+	}
+
+	if *verify && len(createdRefs) > 0 {
+		missing, err := verifyDenyRules(rulesetHref, createdRefs)
+		if err != nil {
+			log.Printf("Verify: failed to re-read rule set %s: %v", rulesetHref, err)
+		} else if len(missing) == 0 {
+			log.Printf("Verify: all %d created deny rule(s) are present in %s", len(createdRefs), rulesetHref)
+		} else {
+			for i, ref := range createdRefs {
+				if containsString(missing, ref) {
+					dr := createdRules[i]
+					log.Printf("Verify: deny rule for env %s service %s (apps: %d) is missing (ref %s)",
+						dr.env.Value, dr.service.Name, len(dr.apps), ref)
+				}
 			}
+			log.Printf("Verify: %d of %d created deny rule(s) missing from %s",
+				len(missing), len(createdRefs), rulesetHref)
 		}
 	}
 
-	// Optional clean-up: delete the rule-set if it stayed empty
-	if len(denyRules) == 0 {
-		log.Printf("No deny rules needed - you may delete the empty rule set %s", rulesetHref)
-		// Uncomment to delete automatically:
-		/*
-			deleteURL := fmt.Sprintf("https://%s:%s/api/v2%s", fqdn, port, rulesetHref)
-			if _, err := apiRequestWithRetry("DELETE", deleteURL, nil); err != nil {
-				log.Printf("Failed to delete empty rule set: %v", err)
+	if *provision && !*dryRun && len(createdRefs) > 0 {
+		note := *provisionNote
+		if note == "" {
+			note = fmt.Sprintf("Auto Deny Rules run %s", runID)
+		}
+		if href, err := provisionRuleset(rulesetHref, note); err != nil {
+			log.Printf("Failed to provision rule set %s: %v", rulesetHref, err)
+		} else {
+			log.Printf("Provisioning rule set %s (%s)...", rulesetHref, href)
+			if err := waitProvisioned(rulesetHref); err != nil {
+				log.Printf("Provisioning of rule set %s not confirmed: %v", rulesetHref, err)
 			} else {
-				log.Printf("Deleted empty rule set %s", rulesetHref)
+				log.Printf("Provisioned rule set %s (%s)", rulesetHref, href)
+			}
+		}
+	}
+
+	// delete the rule set we created if every rule in it failed
+	if createdRuleset && len(ruleHrefs) == 0 {
+		if !*cleanupEmpty {
+			log.Printf("No deny rules were created - you may delete the empty rule set %s", rulesetHref)
+		} else if err := deleteEmptyRuleset(rulesetHref); err != nil {
+			log.Printf("Kept rule set %s: %v", rulesetHref, err)
+		} else {
+			log.Printf("No deny rules were created - deleted the empty rule set %s", rulesetHref)
+			rulesetHref = ""
+		}
+	}
+
+	if *ruleReportPath != "" {
+		if err := writeJSONFile(*ruleReportPath, ruleEntries); err != nil {
+			log.Printf("Failed to write -rule-report: %v", err)
+		} else {
+			log.Printf("Wrote rule report to %s", *ruleReportPath)
+		}
+	}
+	if plan != nil {
+		if err := plan.Close(); err != nil {
+			log.Printf("Failed to finish -output-json file: %v", err)
+		}
+	}
+	if *summaryJSON != "" {
+		summary := map[string]interface{}{
+			"ruleset_href":        rulesetHref,
+			"queries_total":       totalQueries,
+			"queries_done":        atomic.LoadInt64(&doneQueries),
+			"deny_rules_planned":  totalDenyRules,
+			"deny_rules_created":  atomic.LoadInt64(&doneDenyRules),
+			"deny_rules_existing": existingRules,
+			"timed_out":           timedOut,
+			"inconclusive":        atomic.LoadInt64(&inconclusiveQueries),
+		}
+		if len(skippedEnvs) > 0 {
+			summary["skipped_envs"] = skippedEnvs
+		}
+		if *runtimeBudget > 0 {
+			var notAnalyzed []map[string]string
+			for _, c := range skippedCombos {
+				notAnalyzed = append(notAnalyzed, map[string]string{
+					"env": c.ei.env.Value, "service": c.service.Name,
+				})
 			}
-		*/
+			summary["combinations_not_analyzed"] = notAnalyzed
+		}
+		if err := writeJSONFile(*summaryJSON, summary); err != nil {
+			log.Printf("Failed to write -summary-json file: %v", err)
+		}
 	}
 
+	if *saveQueriesFlag && *cleanupSavedQueries {
+		deleteSavedQueries()
+	}
+	for _, se := range skippedEnvs {
+		log.Printf("Skipped env %s: %s", se.Env, se.Reason)
+	}
+	log.Println("Summary:")
+	log.Printf("  queries run:         %d of %d", atomic.LoadInt64(&doneQueries), totalQueries)
+	log.Printf("  no traffic (deny):   %d", atomic.LoadInt64(&noTrafficQueries))
+	log.Printf("  inconclusive:        %d", atomic.LoadInt64(&inconclusiveQueries))
+	log.Printf("  query errors:        %d", atomic.LoadInt64(&erroredQueries))
+	log.Printf("  deny rules created:  %d of %d (%d failed)", atomic.LoadInt64(&doneDenyRules), totalDenyRules, failedDenyRules)
+	log.Printf("  already existed:     %d", existingRules)
+	if timedOut {
+		log.Printf("  cut short:           yes, -run-timeout %s reached", *runTimeout)
+	}
 	log.Println("All queries and deny rules completed.")
+	emitResult(runResult{
+		RulesetHref:       rulesetHref,
+		RuleHrefs:         ruleHrefs,
+		QueriesTotal:      totalQueries,
+		QueriesDone:       atomic.LoadInt64(&doneQueries),
+		DenyRulesPlanned:  totalDenyRules,
+		DenyRulesCreated:  atomic.LoadInt64(&doneDenyRules),
+		DenyRulesFailed:   failedDenyRules,
+		DenyRulesExisting: int64(existingRules),
+		TimedOut:          timedOut,
+		DryRun:            *dryRun,
+	})
+	return exitCode
 }
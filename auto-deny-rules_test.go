@@ -0,0 +1,1205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// stubPCE serves h over TLS and points both PCE clients at it, with
+// instant retries and polls, until the test ends.
+func stubPCE(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewTLSServer(h)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, p, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PCEClient{FQDN: host, Port: p, Org: "1", User: "u", Key: "k"}
+	oldPolicy, oldQuery, oldTransport := policyPCE, queryPCE, httpClient.Transport
+	oldBackoff, oldPoll := backoff, pollInterval
+	policyPCE, queryPCE = c, c
+	httpClient.Transport = srv.Client().Transport
+	backoff = func(int) time.Duration { return 0 }
+	pollInterval = time.Millisecond
+	t.Cleanup(func() {
+		srv.Close()
+		policyPCE, queryPCE, httpClient.Transport = oldPolicy, oldQuery, oldTransport
+		backoff, pollInterval = oldBackoff, oldPoll
+	})
+	return srv
+}
+
+// asyncQueryHandler accepts an async query submit and answers every poll
+// with the given body.
+func asyncQueryHandler(poll string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.Write([]byte(`{"href":"/orgs/1/traffic_flows/async_queries/q1"}`))
+		case "GET":
+			w.Write([]byte(poll))
+		}
+	}
+}
+
+func TestRunAsyncQueryAmbiguousCompletion(t *testing.T) {
+	for _, poll := range []string{
+		`{"status":"completed"}`,
+		`{"status":"completed","flows_count":null}`,
+		`{"status":"completed","flows_count":"many"}`,
+	} {
+		stubPCE(t, asyncQueryHandler(poll))
+		flows, err := runSingleAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, time.Second)
+		if err == nil {
+			t.Errorf("poll %s: got %d flows and no error, want an error", poll, flows)
+		}
+	}
+}
+
+func TestRunAsyncQueryConfirmedZero(t *testing.T) {
+	stubPCE(t, asyncQueryHandler(`{"status":"completed","flows_count":0}`))
+	href, flows, err := runAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, time.Second)
+	if err != nil || flows != 0 || !strings.HasSuffix(href, "/q1") {
+		t.Fatalf("got %q, %d, %v; want q1, 0, nil", href, flows, err)
+	}
+}
+
+func testRule() denyRuleInfo {
+	return denyRuleInfo{
+		env:     Label{Href: "/orgs/1/labels/1", Key: "env", Value: "prod"},
+		service: Service{Href: "/orgs/1/sec_policy/draft/services/7", Name: "SMB"},
+		apps:    []Label{{Href: "/orgs/1/labels/10", Key: "app", Value: "web"}},
+	}
+}
+
+const testIPList = "/orgs/1/sec_policy/draft/ip_lists/1"
+
+// actorKeys lists the actor type of each provider or consumer entry.
+func actorKeys(t *testing.T, v interface{}) []string {
+	t.Helper()
+	var keys []string
+	for _, a := range v.([]map[string]map[string]string) {
+		for k := range a {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func TestDenyRulePayloadDirections(t *testing.T) {
+	for _, tc := range []struct {
+		egress               bool
+		providers, consumers string
+	}{
+		{false, "label,label", "ip_list"},
+		{true, "ip_list", "label,label"},
+	} {
+		dr := testRule()
+		dr.egress = tc.egress
+		payload, err := denyRulePayload(dr, []string{testIPList})
+		if err != nil {
+			t.Fatalf("egress=%v: %v", tc.egress, err)
+		}
+		if got := strings.Join(actorKeys(t, payload["providers"]), ","); got != tc.providers {
+			t.Errorf("egress=%v: providers %s, want %s", tc.egress, got, tc.providers)
+		}
+		if got := strings.Join(actorKeys(t, payload["consumers"]), ","); got != tc.consumers {
+			t.Errorf("egress=%v: consumers %s, want %s", tc.egress, got, tc.consumers)
+		}
+		ingress := payload["ingress_services"].([]map[string]string)
+		if len(ingress) != 1 || ingress[0]["href"] != dr.service.Href {
+			t.Errorf("egress=%v: ingress_services %v, want the service", tc.egress, ingress)
+		}
+		if egress := payload["egress_services"].([]interface{}); len(egress) != 0 {
+			t.Errorf("egress=%v: egress_services %v, want none", tc.egress, egress)
+		}
+	}
+}
+
+// deleteRecorder answers polls with poll (or status when set) and counts
+// the DELETEs of the query.
+func deleteRecorder(poll string, status int, deletes *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			w.Write([]byte(`{"href":"/orgs/1/traffic_flows/async_queries/q1"}`))
+		case "DELETE":
+			atomic.AddInt32(deletes, 1)
+			w.WriteHeader(http.StatusNoContent)
+		case "GET":
+			if status != 0 {
+				w.WriteHeader(status)
+				return
+			}
+			w.Write([]byte(poll))
+		}
+	}
+}
+
+func TestRunAsyncQueryDeletesAbandonedQuery(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		poll   string
+		status int
+	}{
+		{"timeout", `{"status":"working"}`, 0},
+		{"poll error", "", http.StatusServiceUnavailable},
+		{"undecodable poll", "<html>", 0},
+	} {
+		var deletes int32
+		stubPCE(t, deleteRecorder(tc.poll, tc.status, &deletes))
+		if _, err := runSingleAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, 50*time.Millisecond); err == nil {
+			t.Errorf("%s: want an error", tc.name)
+		}
+		if n := atomic.LoadInt32(&deletes); n != 1 {
+			t.Errorf("%s: %d DELETE(s), want 1", tc.name, n)
+		}
+	}
+}
+
+func TestRunAsyncQueryKeepsTerminalQuery(t *testing.T) {
+	var deletes int32
+	stubPCE(t, deleteRecorder(`{"status":"completed","flows_count":3}`, 0, &deletes))
+	if _, err := runSingleAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&deletes); n != 0 {
+		t.Errorf("%d DELETE(s) of a completed query, want 0", n)
+	}
+}
+
+func TestLoadConfigLeavesRequiredFieldsToFlags(t *testing.T) {
+	t.Setenv("PCE_API_KEY", "")
+	path := filepath.Join(t.TempDir(), "pce.json")
+	if err := os.WriteFile(path, []byte(`{"fqdn":"pce","port":"8443","org":"1","user":"u"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatalf("loadConfig without a key: %v", err)
+	}
+	if err := cfg.checkRequired(); err == nil {
+		t.Error("config alone: want a missing key error")
+	}
+	if err := mergeConfig(cfg, Config{Key: "secret"}).checkRequired(); err != nil {
+		t.Errorf("config plus -key: %v", err)
+	}
+}
+
+func TestResultCacheRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+	env, svc := testRule().env, testRule().service
+	scope := appScope{app: testRule().apps[0]}
+	key := cacheKey(env, scope, svc, querySettingsKey(svc, false, false))
+	want := cacheEntry{Key: key, NoTraffic: true, Windows: []windowResult{{Window: "24h", Flows: 0}}}
+
+	c, err := openResultCache(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.put(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = openResultCache(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, ok := c.get(key)
+	if !ok {
+		t.Fatal("entry missing after reopening the cache")
+	}
+	if got.Key != want.Key || got.NoTraffic != want.NoTraffic || len(got.Windows) != 1 || got.Windows[0].Window != "24h" || got.Time.IsZero() {
+		t.Errorf("got %+v, want %+v with a time", got, want)
+	}
+	if _, ok := c.get(cacheKey(env, scope, svc, querySettingsKey(svc, true, false))); ok {
+		t.Error("entry reused with different query settings")
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+	c, err := openResultCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.put(cacheEntry{Key: "old", NoTraffic: true, Time: time.Now().Add(-48 * time.Hour)})
+	c.put(cacheEntry{Key: "new", NoTraffic: true})
+	c.Close()
+
+	c, err = openResultCache(path, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, ok := c.get("old"); ok {
+		t.Error("expired entry was kept")
+	}
+	if _, ok := c.get("new"); !ok {
+		t.Error("fresh entry was dropped")
+	}
+}
+
+func TestCreateDenyRulesAttemptsAll(t *testing.T) {
+	var posts, inFlight, maxInFlight int32
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&posts, 1)
+		cur := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			peak := atomic.LoadInt32(&maxInFlight)
+			if cur <= peak || atomic.CompareAndSwapInt32(&maxInFlight, peak, cur) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if n%3 == 0 {
+			// a rejected rule must not stop the others
+			w.WriteHeader(http.StatusNotAcceptable)
+			return
+		}
+		w.Write([]byte(`{"href":"/orgs/1/sec_policy/draft/rule_sets/1/deny_rules/1"}`))
+	})
+	rules := make([]denyRuleInfo, 12)
+	for i := range rules {
+		rules[i] = testRule()
+	}
+	var recorded, failed int
+	createDenyRules("/orgs/1/sec_policy/draft/rule_sets/1", rules, []string{testIPList}, 4, func(dr denyRuleInfo, href string, err error) {
+		recorded++
+		if err != nil {
+			failed++
+		}
+	})
+	if n := atomic.LoadInt32(&posts); n != int32(len(rules)) {
+		t.Errorf("%d POSTs, want %d", n, len(rules))
+	}
+	if recorded != len(rules) || failed != len(rules)/3 {
+		t.Errorf("recorded %d outcomes (%d failed), want %d (%d failed)", recorded, failed, len(rules), len(rules)/3)
+	}
+	if peak := atomic.LoadInt32(&maxInFlight); peak < 2 || peak > 4 {
+		t.Errorf("%d rules created at once, want 2-4", peak)
+	}
+}
+
+func TestRunAsyncQueryCancelAbortsPoll(t *testing.T) {
+	var deletes int32
+	stubPCE(t, deleteRecorder(`{"status":"working"}`, 0, &deletes))
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := runSingleAsyncQuery(ctx, asyncQueriesURL(), map[string]interface{}{}, time.Minute)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("poll took %s to stop after cancel", d)
+	}
+	if n := atomic.LoadInt32(&deletes); n != 1 {
+		t.Errorf("%d DELETE(s) of the cancelled query, want 1", n)
+	}
+}
+
+func TestAcquireGivesUpOnCancel(t *testing.T) {
+	sem := make(chan struct{}, 1)
+	sem <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if acquire(ctx, sem) {
+		t.Error("acquired a full semaphore after cancel")
+	}
+	if !acquire(ctx, nil) {
+		t.Error("a nil semaphore must always be acquired")
+	}
+}
+
+func TestWorkloadParamKeepsCommas(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	var pairs repeatedList
+	fs.Var(&pairs, "workload-param", "")
+	if err := fs.Parse([]string{"-workload-param", "os_id=a,b", "-workload-param", "hostname=x"}); err != nil {
+		t.Fatal(err)
+	}
+	params, err := parseWorkloadParams(pairs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := params.Get("os_id"); got != "a,b" {
+		t.Errorf("os_id = %q, want a,b", got)
+	}
+	if got := params.Get("hostname"); got != "x" {
+		t.Errorf("hostname = %q, want x", got)
+	}
+}
+
+// providerHrefs lists the label hrefs of a payload's providers.
+func providerHrefs(payload map[string]interface{}) []string {
+	var hrefs []string
+	for _, a := range payload["providers"].([]map[string]map[string]string) {
+		hrefs = append(hrefs, a["label"]["href"])
+	}
+	return hrefs
+}
+
+func TestDenyRulePayloadExtraDimensions(t *testing.T) {
+	old := providerDimensions
+	providerDimensions = []string{"env", "app", "loc"}
+	defer func() { providerDimensions = old }()
+
+	dr := testRule()
+	dr.extras = []Label{{Href: "/orgs/1/labels/20", Key: "loc", Value: "eu"}}
+	payload, err := denyRulePayload(dr, []string{testIPList})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "/orgs/1/labels/1,/orgs/1/labels/20,/orgs/1/labels/10"
+	if got := strings.Join(providerHrefs(payload), ","); got != want {
+		t.Errorf("providers %s, want env, loc, app: %s", got, want)
+	}
+
+	// a rule missing a configured dimension would deny more than was analyzed
+	dr.extras = nil
+	if _, err := denyRulePayload(dr, []string{testIPList}); err == nil {
+		t.Error("rule without a loc label: want an error")
+	}
+}
+
+func TestHasLabelsFetchesOne(t *testing.T) {
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("max_results") != "1" {
+			t.Errorf("max_results = %q, want 1", r.URL.Query().Get("max_results"))
+		}
+		if r.URL.Query().Get("key") == "loc" {
+			w.Write([]byte(`[{"href":"/orgs/1/labels/20","key":"loc","value":"eu"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+	for key, want := range map[string]bool{"loc": true, "role": false} {
+		got, err := hasLabels(key)
+		if err != nil || got != want {
+			t.Errorf("hasLabels(%s) = %v, %v; want %v", key, got, err, want)
+		}
+	}
+}
+
+func TestThrottleSamplesTimedOutQueries(t *testing.T) {
+	var deletes int32
+	stubPCE(t, deleteRecorder(`{"status":"working"}`, 0, &deletes))
+	old := queryThrottle
+	queryThrottle = &latencyThrottle{threshold: 10 * time.Millisecond}
+	defer func() { queryThrottle = old }()
+	if _, err := runSingleAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, 30*time.Millisecond); err == nil {
+		t.Fatal("want a timeout error")
+	}
+	queryThrottle.mu.Lock()
+	defer queryThrottle.mu.Unlock()
+	if len(queryThrottle.samples) != 1 || !queryThrottle.engaged {
+		t.Errorf("%d sample(s), engaged %v; want the timed-out query to engage the throttle", len(queryThrottle.samples), queryThrottle.engaged)
+	}
+}
+
+func TestRedactLabelValuesAsTokens(t *testing.T) {
+	oldOn, oldValues, oldRe := redactLogs, redactValues, redactRe
+	redactLogs, redactValues, redactRe = true, make(map[string]string), nil
+	defer func() { redactLogs, redactValues, redactRe = oldOn, oldValues, oldRe }()
+	redactRegister("label", "Prod (EU)", "web", "db", "cache")
+
+	tok := func(v string) string { return redactToken("label", v) }
+	for in, want := range map[string]string{
+		"env Prod (EU) app web":    "env " + tok("Prod (EU)") + " app " + tok("web"),
+		"Env:Prod (EU)  App:web":   "Env:" + tok("Prod (EU)") + "  App:" + tok("web"),
+		"apps: [web,db,cache]":     "apps: [" + tok("web") + "," + tok("db") + "," + tok("cache") + "]",
+		"web-frontend webhook":     "web-frontend webhook",
+		"cached result for dbx db": "cached result for dbx " + tok("db"),
+	} {
+		if got := redact(in); got != want {
+			t.Errorf("redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+
+	redactRegister("host", "pce.example.com")
+	host := redactToken("host", "pce.example.com")
+	ip := func(v string) string { return redactToken("ip", v) }
+	for in, want := range map[string]string{
+		"GET https://pce.example.com:8443/api/v2/orgs/1/labels?value=web&key=app": "GET https://" + host + ":8443/api/v2" +
+			redactToken("href", "/orgs/1/labels") + "?value=" + tok("web") + "&key=app",
+		"as admin@pce.example.com":                   "as admin@" + host,
+		"flow fe80::1 to 2001:db8::5/64 at 12:34:56": "flow " + ip("fe80::1") + " to " + ip("2001:db8::5/64") + " at 12:34:56",
+		"mac aa:bb:cc:dd:ee:ff":                      "mac aa:bb:cc:dd:ee:ff",
+	} {
+		if got := redact(in); got != want {
+			t.Errorf("redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestIncludeUnlabeledNeedsUnlabeledEnv(t *testing.T) {
+	oldInclude, oldFilter := includeUnlabeled, hostnameFilter
+	includeUnlabeled = true
+	defer func() { includeUnlabeled, hostnameFilter = oldInclude, oldFilter }()
+	env := testRule().env
+
+	var body string
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) })
+
+	body = `[{"hostname":"a","labels":[{"href":"/orgs/1/labels/1","key":"env","value":"prod"}]}]`
+	apps, err := getWorkloadsForEnv(env)
+	if err != nil || len(apps) != 1 || !apps[0].envWide() {
+		t.Fatalf("unlabeled env: got %v, %v; want one env-wide scope", apps, err)
+	}
+
+	// the app-labeled workload is only filtered out, so the env isn't unlabeled
+	hostnameFilter = regexp.MustCompile(`^a$`)
+	body = `[{"hostname":"a","labels":[]},{"hostname":"b","labels":[{"href":"/orgs/1/labels/10","key":"app","value":"web"}]}]`
+	apps, err = getWorkloadsForEnv(env)
+	if err != nil || len(apps) != 0 {
+		t.Fatalf("filtered env: got %v, %v; want no scopes", apps, err)
+	}
+
+	// an env-wide rule would also cover the hosts -hostname-regex excludes
+	hostnameFilter = regexp.MustCompile(`^win`)
+	for _, body = range []string{
+		`[{"hostname":"lin1","labels":[]}]`,
+		`[{"hostname":"win1","labels":[]},{"hostname":"lin1","labels":[]}]`,
+	} {
+		apps, err = getWorkloadsForEnv(env)
+		if err != nil || len(apps) != 0 {
+			t.Errorf("unlabeled env with -hostname-regex, %s: got %v, %v; want no scopes", body, apps, err)
+		}
+	}
+}
+
+func TestReadServicesFileAcceptsPCEExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.json")
+	export := `[{"href":"/orgs/1/sec_policy/draft/services/7","name":"SMB","description":"","is_ransomware":true,
+		"created_at":"2024-01-01T00:00:00Z","service_ports":[{"port":445,"proto":6},{"port":137,"to_port":139,"proto":17}]}]`
+	if err := os.WriteFile(path, []byte(export), 0600); err != nil {
+		t.Fatal(err)
+	}
+	services, err := readServicesFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services[0].Name != "SMB" || len(services[0].ServicePorts) != 2 {
+		t.Errorf("got %+v", services)
+	}
+
+	if err := os.WriteFile(path, []byte(`[{"href":"/orgs/1/sec_policy/draft/services/7","name":"SMB"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readServicesFile(path); err == nil {
+		t.Error("service without service_ports: want an error")
+	}
+}
+
+func TestProgressBarKeepsFileSinks(t *testing.T) {
+	var terminal, file strings.Builder
+	oldSinks, oldBar := logSinks, progressBar
+	logSinks = []logSink{{w: &terminal}, {w: &file, json: true}}
+	progressBar = true
+	defer func() { logSinks, progressBar, barDrawn = oldSinks, oldBar, false }()
+
+	logQueryProgress(testRule().env, appScope{app: testRule().apps[0]}, testRule().service, 1, 4)
+	if strings.Contains(terminal.String(), "[Query]") {
+		t.Errorf("terminal sink got the per-query line: %q", terminal.String())
+	}
+	if !strings.Contains(file.String(), `"progress_pct":25`) {
+		t.Errorf("file sink missed the progress event: %q", file.String())
+	}
+}
+
+func TestBackoffDelayRespectsCap(t *testing.T) {
+	oldBase, oldMax, oldJitter := retryBackoffBase, retryMaxBackoff, retryJitter
+	retryBackoffBase, retryMaxBackoff, retryJitter = time.Second, 5*time.Second, 0.5
+	defer func() { retryBackoffBase, retryMaxBackoff, retryJitter = oldBase, oldMax, oldJitter }()
+	for attempt := 0; attempt < 64; attempt++ {
+		for i := 0; i < 20; i++ {
+			d := backoffDelay(attempt)
+			if d > retryMaxBackoff {
+				t.Fatalf("attempt %d: backoff %s above -retry-max-backoff %s", attempt, d, retryMaxBackoff)
+			}
+			if attempt >= 3 && d < retryMaxBackoff/2 {
+				t.Fatalf("attempt %d: backoff %s below the jittered cap", attempt, d)
+			}
+		}
+	}
+
+	retryJitter = 0
+	for attempt, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second} {
+		if d := backoffDelay(attempt); d != want {
+			t.Errorf("attempt %d without jitter: %s, want %s", attempt, d, want)
+		}
+	}
+}
+
+func TestRunAsyncQueryEmptySubmitBody(t *testing.T) {
+	var submits int32
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&submits, 1)
+		w.WriteHeader(http.StatusOK)
+	})
+	_, err := runSingleAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "empty body") {
+		t.Fatalf("got %v, want an empty body error", err)
+	}
+	if n := atomic.LoadInt32(&submits); n != emptySubmitAttempts {
+		t.Errorf("%d submit(s), want %d", n, emptySubmitAttempts)
+	}
+}
+
+// connectProxy is a stub HTTPS proxy that tunnels CONNECT requests and
+// counts them.
+func connectProxy(t *testing.T, connects *int32) *httptest.Server {
+	t.Helper()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "want CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(connects, 1)
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(dst, conn)
+			dst.Close()
+		}()
+		io.Copy(conn, dst)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyTransportForwardsRequests(t *testing.T) {
+	var connects int32
+	seen := make(chan string, 2)
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Method
+		w.Write([]byte(`{}`))
+	})
+	proxy := connectProxy(t, &connects)
+	tr, err := newTransport(true, "", proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.DisableKeepAlives = true // one tunnel per request
+	httpClient.Transport = tr
+
+	for _, method := range []string{"GET", "POST"} {
+		if _, err := apiRequestWithRetry(context.Background(), policyPCE, method, policyPCE.orgURL("/labels", nil), nil); err != nil {
+			t.Fatalf("%s through the proxy: %v", method, err)
+		}
+		if got := <-seen; got != method {
+			t.Errorf("PCE saw %s, want %s", got, method)
+		}
+	}
+	if n := atomic.LoadInt32(&connects); n != 2 {
+		t.Errorf("%d CONNECT(s) through the proxy, want 2", n)
+	}
+}
+
+// pagedHandler serves items as a list endpoint honouring offset and
+// max_results, with X-Total-Count set, and counts the pages served.
+func pagedHandler(items []string, pages *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(pages, 1)
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("max_results"))
+		end := len(items)
+		if offset > end {
+			offset = end
+		}
+		if limit > 0 && offset+limit < end {
+			end = offset + limit
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+		w.Write([]byte("[" + strings.Join(items[offset:end], ",") + "]"))
+	}
+}
+
+func TestGetEnvsPages(t *testing.T) {
+	old := pageSize
+	pageSize = 2
+	defer func() { pageSize = old }()
+	var items []string
+	for i := 1; i <= 5; i++ {
+		items = append(items, fmt.Sprintf(`{"href":"/orgs/1/labels/%d","key":"env","value":"e%d"}`, i, i))
+	}
+	var pages int32
+	stubPCE(t, pagedHandler(items, &pages))
+
+	envs, err := getEnvs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 5 || envs[0].Value != "e1" || envs[4].Value != "e5" {
+		t.Errorf("got %+v, want e1..e5", envs)
+	}
+	if n := atomic.LoadInt32(&pages); n != 3 {
+		t.Errorf("fetched %d page(s), want 3", n)
+	}
+}
+
+func TestGetWorkloadsForEnvPages(t *testing.T) {
+	old := pageSize
+	pageSize = 1
+	defer func() { pageSize = old }()
+	items := []string{
+		`{"hostname":"a","labels":[{"href":"/orgs/1/labels/10","key":"app","value":"web"}]}`,
+		`{"hostname":"b","labels":[{"href":"/orgs/1/labels/11","key":"app","value":"db"}]}`,
+	}
+	var pages int32
+	stubPCE(t, pagedHandler(items, &pages))
+
+	apps, err := getWorkloadsForEnv(testRule().env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, a := range apps {
+		got[a.app.Value] = true
+	}
+	if len(apps) != 2 || !got["web"] || !got["db"] {
+		t.Errorf("got apps %v, want web and db from both pages", got)
+	}
+	if n := atomic.LoadInt32(&pages); n != 2 {
+		t.Errorf("fetched %d page(s), want 2", n)
+	}
+}
+
+func TestGetIPListHrefExactMatch(t *testing.T) {
+	old := pageSize
+	pageSize = 1
+	defer func() { pageSize = old }()
+	var pages int32
+
+	// name= matches substrings, and the exact name sits on the second page
+	stubPCE(t, pagedHandler([]string{
+		`{"href":"/orgs/1/sec_policy/draft/ip_lists/2","name":"Any (0.0.0.0/0) old"}`,
+		`{"href":"/orgs/1/sec_policy/draft/ip_lists/1","name":"Any (0.0.0.0/0)"}`,
+	}, &pages))
+	href, err := getIPListHref("Any (0.0.0.0/0)")
+	if err != nil || href != testIPList {
+		t.Errorf("got %q, %v; want %s", href, err, testIPList)
+	}
+	if n := atomic.LoadInt32(&pages); n != 2 {
+		t.Errorf("fetched %d page(s), want 2", n)
+	}
+
+	stubPCE(t, pagedHandler([]string{
+		`{"href":"/orgs/1/sec_policy/draft/ip_lists/1","name":"corp"}`,
+		`{"href":"/orgs/1/sec_policy/draft/ip_lists/3","name":"corp"}`,
+	}, &pages))
+	if _, err := getIPListHref("corp"); err == nil || !strings.Contains(err.Error(), "2 IP-lists") {
+		t.Errorf("duplicate names: got %v, want an ambiguity error", err)
+	}
+
+	stubPCE(t, pagedHandler([]string{
+		`{"href":"/orgs/1/sec_policy/draft/ip_lists/4","name":"corp-dmz"}`,
+	}, &pages))
+	if _, err := getIPListHref("corp"); err == nil || !strings.Contains(err.Error(), "1 partial match") {
+		t.Errorf("substring only: got %v, want a not-found error", err)
+	}
+}
+
+// closeCounter wraps a transport and counts response bodies opened and
+// closed.
+type closeCounter struct {
+	next           http.RoundTripper
+	opened, closed int32
+}
+
+type countedBody struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (b countedBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+func (c *closeCounter) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := c.next.RoundTrip(req)
+	if err == nil {
+		atomic.AddInt32(&c.opened, 1)
+		resp.Body = countedBody{resp.Body, &c.closed}
+	}
+	return resp, err
+}
+
+func TestRetriesCloseEveryBody(t *testing.T) {
+	oldAttempts := retryAttempts
+	retryAttempts = 3
+	defer func() { retryAttempts = oldAttempts }()
+	var calls int32
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	})
+	cc := &closeCounter{next: httpClient.Transport}
+	httpClient.Transport = cc
+
+	if _, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.orgURL("/labels", nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	if cc.opened != 3 || cc.closed != 3 {
+		t.Errorf("opened %d and closed %d bodies, want 3 and 3", cc.opened, cc.closed)
+	}
+}
+
+func TestRunAsyncQueryTerminalFailure(t *testing.T) {
+	for poll, want := range map[string]string{
+		`{"status":"failed","error":"disk full"}`:          "failed: disk full",
+		`{"status":"cancelled","message":"by admin"}`:      "cancelled: by admin",
+		`{"status":"failed"}`:                              "q1 failed",
+		`{"status":"cancelled","error":"","message":"op"}`: "cancelled: op",
+	} {
+		stubPCE(t, asyncQueryHandler(poll))
+		_, _, err := runAsyncQuery(context.Background(), asyncQueriesURL(), map[string]interface{}{}, 10*time.Second)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("poll %s: got %v, want an error containing %q", poll, err, want)
+		}
+	}
+}
+
+// failingHandler answers the first fails requests with status and the rest
+// with an empty object, counting every call.
+func failingHandler(fails int32, status int, calls *int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= fails {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}
+}
+
+func TestRetryAttemptsIsTotalTries(t *testing.T) {
+	old := retryAttempts
+	retryAttempts = 4
+	defer func() { retryAttempts = old }()
+
+	var calls int32
+	stubPCE(t, failingHandler(3, http.StatusServiceUnavailable, &calls))
+	if _, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.orgURL("/labels", nil), nil); err != nil {
+		t.Fatalf("success on the last attempt: %v", err)
+	}
+	if calls != 4 {
+		t.Errorf("%d attempt(s), want 4", calls)
+	}
+
+	calls = 0
+	stubPCE(t, failingHandler(4, http.StatusServiceUnavailable, &calls))
+	if _, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.orgURL("/labels", nil), nil); err == nil {
+		t.Error("failing every attempt: got no error")
+	}
+	if calls != 4 {
+		t.Errorf("%d attempt(s), want 4", calls)
+	}
+}
+
+func TestRetryOnlyTransientStatuses(t *testing.T) {
+	old := retryAttempts
+	retryAttempts = 3
+	defer func() { retryAttempts = old }()
+
+	for _, tc := range []struct {
+		status int
+		calls  int32
+	}{
+		{http.StatusUnauthorized, 1},
+		{http.StatusBadRequest, 1},
+		{http.StatusServiceUnavailable, 3},
+		{http.StatusTooManyRequests, 3},
+	} {
+		var calls int32
+		stubPCE(t, failingHandler(100, tc.status, &calls))
+		_, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.orgURL("/labels", nil), nil)
+		var se *httpStatusError
+		if !errors.As(err, &se) || se.StatusCode != tc.status {
+			t.Errorf("HTTP %d: got %v, want an httpStatusError", tc.status, err)
+		}
+		if calls != tc.calls {
+			t.Errorf("HTTP %d: %d attempt(s), want %d", tc.status, calls, tc.calls)
+		}
+	}
+}
+
+func TestGuardQueryRecordsPanics(t *testing.T) {
+	sem := make(chan struct{}, 2)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reasons []string
+	for i := 0; i < 4; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer release(sem)
+			defer guardQuery(func(r interface{}) {
+				mu.Lock()
+				reasons = append(reasons, fmt.Sprint("panic: ", r))
+				mu.Unlock()
+			})
+			if i%2 == 0 {
+				panic(fmt.Sprintf("query %d", i))
+			}
+		}(i)
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("wg.Wait hung after panicking queries")
+	}
+	if len(reasons) != 2 || len(sem) != 0 {
+		t.Errorf("got %d recorded panic(s) and %d held slot(s), want 2 and 0", len(reasons), len(sem))
+	}
+}
+
+func TestServicePortRanges(t *testing.T) {
+	svc := Service{Name: "RPC", ServicePorts: []ServicePort{
+		{Port: 135, Proto: 6},
+		{Port: 49152, Proto: 6, ToPort: 65535},
+	}}
+	if err := validateServicePorts(svc); err != nil {
+		t.Fatalf("valid range rejected: %v", err)
+	}
+	ports := servicePortsPayload(svc)
+	if len(ports) != 2 {
+		t.Fatalf("got %d port entries, want 2", len(ports))
+	}
+	if _, ok := ports[0]["to_port"]; ok {
+		t.Errorf("single port got a to_port: %v", ports[0])
+	}
+	if ports[1]["port"] != 49152 || ports[1]["to_port"] != 65535 || ports[1]["proto"] != 6 {
+		t.Errorf("range entry %v, want 49152-65535/tcp", ports[1])
+	}
+
+	for _, sp := range []ServicePort{
+		{Port: 200, Proto: 6, ToPort: 100},
+		{Port: 1000, Proto: 17, ToPort: 70000},
+		{Port: 0, Proto: 6},
+	} {
+		if err := validateServicePorts(Service{ServicePorts: []ServicePort{sp}}); err == nil {
+			t.Errorf("%+v: got no error", sp)
+		}
+	}
+}
+
+func TestRetryUsesBackoffHook(t *testing.T) {
+	old := retryAttempts
+	retryAttempts = 3
+	defer func() { retryAttempts = old }()
+	var calls int32
+	stubPCE(t, failingHandler(100, http.StatusServiceUnavailable, &calls))
+	var attempts []int
+	backoff = func(attempt int) time.Duration {
+		attempts = append(attempts, attempt)
+		return 0
+	}
+
+	start := time.Now()
+	if _, err := apiRequestWithRetry(context.Background(), policyPCE, "GET", policyPCE.orgURL("/labels", nil), nil); err == nil {
+		t.Fatal("got no error")
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("retries took %s with a zero backoff", d)
+	}
+	if len(attempts) != 3 || attempts[0] != 0 || attempts[2] != 2 {
+		t.Errorf("backoff called with %v, want [0 1 2]", attempts)
+	}
+}
+
+func TestParseFlowsCount(t *testing.T) {
+	for _, tc := range []struct {
+		in   interface{}
+		want int64
+		ok   bool
+	}{
+		{float64(42), 42, true},
+		{json.Number("7"), 7, true},
+		{json.Number("12.0"), 12, true},
+		{json.Number("1e3"), 1000, true},
+		{" 5 ", 5, true},
+		{"0", 0, true},
+		{nil, 0, false},
+		{"many", 0, false},
+		{json.Number("x"), 0, false},
+		{true, 0, false},
+		{[]interface{}{1}, 0, false},
+	} {
+		got, err := parseFlowsCount(tc.in)
+		if tc.ok && (err != nil || got != tc.want) {
+			t.Errorf("parseFlowsCount(%#v) = %d, %v; want %d", tc.in, got, err, tc.want)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("parseFlowsCount(%#v) = %d; want an error", tc.in, got)
+		}
+	}
+}
+
+func TestURLsUseAPIVersion(t *testing.T) {
+	old := apiVersion
+	apiVersion = "v3"
+	defer func() { apiVersion = old }()
+	c := &PCEClient{FQDN: "pce.example.com", Port: "8443", Org: "2"}
+
+	if got, want := c.pceURL("/users", nil), "https://pce.example.com:8443/api/v3/users"; got != want {
+		t.Errorf("pceURL = %s, want %s", got, want)
+	}
+	if got, want := c.orgURL("/labels", nil), "https://pce.example.com:8443/api/v3/orgs/2/labels"; got != want {
+		t.Errorf("orgURL = %s, want %s", got, want)
+	}
+}
+
+func TestPCEURL(t *testing.T) {
+	c := &PCEClient{FQDN: "pce.example.com", Port: "8443", Org: "1"}
+	for _, tc := range []struct {
+		path, want string
+	}{
+		{"/orgs/1/traffic_flows/async_queries/q1", "https://pce.example.com:8443/api/v2/orgs/1/traffic_flows/async_queries/q1"},
+		{"/orgs/1/sec_policy/draft/rule_sets/5/deny_rules", "https://pce.example.com:8443/api/v2/orgs/1/sec_policy/draft/rule_sets/5/deny_rules"},
+	} {
+		if got := c.pceURL(tc.path, nil); got != tc.want {
+			t.Errorf("pceURL(%s) = %s, want %s", tc.path, got, tc.want)
+		}
+	}
+
+	v6 := &PCEClient{FQDN: "::1", Port: "8443", Org: "1"}
+	if got, want := v6.orgURL("/labels", nil), "https://[::1]:8443/api/v2/orgs/1/labels"; got != want {
+		t.Errorf("IPv6 orgURL = %s, want %s", got, want)
+	}
+
+	query := url.Values{
+		"labels": {`[["/orgs/1/labels/1"]]`},
+		"name":   {"Any (0.0.0.0/0) & more"},
+	}
+	got := c.orgURL("/workloads", query)
+	want := "https://pce.example.com:8443/api/v2/orgs/1/workloads?labels=%5B%5B%22%2Forgs%2F1%2Flabels%2F1%22%5D%5D&name=Any+%280.0.0.0%2F0%29+%26+more"
+	if got != want {
+		t.Errorf("orgURL with query = %s, want %s", got, want)
+	}
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("labels") != query.Get("labels") || u.Query().Get("name") != query.Get("name") {
+		t.Errorf("query %v did not round-trip through %s", query, got)
+	}
+}
+
+func TestDenyRulePayloadMultipleIPLists(t *testing.T) {
+	second := "/orgs/1/sec_policy/draft/ip_lists/2"
+	payload, err := denyRulePayload(testRule(), []string{testIPList, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	consumers := payload["consumers"].([]map[string]map[string]string)
+	if len(consumers) != 2 {
+		t.Fatalf("got %d consumer(s), want 2", len(consumers))
+	}
+	for i, want := range []string{testIPList, second} {
+		if got := consumers[i]["ip_list"]["href"]; got != want {
+			t.Errorf("consumer %d: ip_list %q, want %s", i, got, want)
+		}
+	}
+}
+
+func TestServiceConcurrencySurvivesFlags(t *testing.T) {
+	oldConn := []string{fqdn, port, org, user, key}
+	oldLimits, oldConcurrency, oldTimeout := serviceConcurrency, queryConcurrency, httpClient.Timeout
+	defer func() {
+		fqdn, port, org, user, key = oldConn[0], oldConn[1], oldConn[2], oldConn[3], oldConn[4]
+		serviceConcurrency, queryConcurrency, httpClient.Timeout = oldLimits, oldConcurrency, oldTimeout
+	}()
+	path := filepath.Join(t.TempDir(), "pce.json")
+	if err := os.WriteFile(path, []byte(`{"fqdn":"pce","port":"8443","org":"1","user":"u","key":"k","service_concurrency":{"SMB":1}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// run applies the file, then the connection flags, which carry no limits
+	applyConfig(cfg)
+	applyConfig(Config{FQDN: "other"})
+	if serviceConcurrency["SMB"] != 1 || fqdn != "other" {
+		t.Errorf("got service_concurrency %v and fqdn %q, want SMB:1 and the -fqdn flag", serviceConcurrency, fqdn)
+	}
+}
+
+// batchHandler answers a per-service async query whose poll reports flows
+// and whose download returns records.
+func batchHandler(flows int, records string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST":
+			w.Write([]byte(`{"href":"/orgs/1/traffic_flows/async_queries/q1"}`))
+		case strings.HasSuffix(r.URL.Path, "/download"):
+			w.Write([]byte(records))
+		default:
+			fmt.Fprintf(w, `{"status":"completed","flows_count":%d}`, flows)
+		}
+	}
+}
+
+func TestSubmitServiceQueryUnattributedFlows(t *testing.T) {
+	dr := testRule()
+	scopes := []appScope{{app: dr.apps[0]}}
+	web := `{"dst":{"ip":"10.0.0.1","workload":{"labels":[{"href":"/orgs/1/labels/1"},{"href":"/orgs/1/labels/10"}]}}}`
+	for name, tc := range map[string]struct {
+		flows   int
+		records string
+	}{
+		"no workload":    {2, `[` + web + `,{"dst":{"ip":"10.0.0.9"}}]`},
+		"other app":      {2, `[` + web + `,{"dst":{"ip":"10.0.0.2","workload":{"labels":[{"href":"/orgs/1/labels/11"}]}}}]`},
+		"short download": {3, `[` + web + `]`},
+	} {
+		stubPCE(t, batchHandler(tc.flows, tc.records))
+		_, err := submitServiceQuery(context.Background(), dr.env, scopes, dr.service, false, false)
+		if !errors.Is(err, errBatchUnattributed) {
+			t.Errorf("%s: got %v, want errBatchUnattributed", name, err)
+		}
+	}
+
+	stubPCE(t, batchHandler(1, `[`+web+`]`))
+	results, err := submitServiceQuery(context.Background(), dr.env, scopes, dr.service, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[labelsKey(scopeLabels(dr.env, scopes[0]))]; r.ok {
+		t.Error("app with an attributed flow judged quiet")
+	}
+}
+
+func TestThrottleWaitStopsOnCancel(t *testing.T) {
+	old := queryThrottle
+	queryThrottle = &latencyThrottle{threshold: time.Second, samples: []time.Duration{time.Hour}, engaged: true}
+	defer func() { queryThrottle = old }()
+	stubPCE(t, asyncQueryHandler(`{"status":"completed","flows_count":0}`))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := runAsyncQuery(ctx, asyncQueriesURL(), map[string]interface{}{}, time.Second)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the context's deadline error", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("throttled submission took %s after the context ended", d)
+	}
+}
+
+func TestSaveQueriesFollowDirection(t *testing.T) {
+	oldDirection, oldSingle, oldSaved := ruleDirection, singleWindow, savedQueries
+	ruleDirection, singleWindow = "egress", true
+	defer func() { ruleDirection, singleWindow, savedQueries = oldDirection, oldSingle, oldSaved }()
+	var posted []map[string]interface{}
+	stubPCE(t, func(w http.ResponseWriter, r *http.Request) {
+		var q map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&q)
+		posted = append(posted, q)
+		w.Write([]byte(`{"href":"/orgs/1/traffic_flows/saved_queries/1"}`))
+	})
+	dr := testRule()
+	scope := appScope{app: dr.apps[0]}
+
+	if err := saveQueries(dr.env, scope, dr.service, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 1 {
+		t.Fatalf("saved %d queries, want 1 for -direction egress -single-window", len(posted))
+	}
+	sources := posted[0]["sources"].(map[string]interface{})["include"].([]interface{})
+	if len(sources) != 1 || len(sources[0].([]interface{})) != 2 {
+		t.Errorf("sources %v, want the app scope as the egress source", sources)
+	}
+	if name := posted[0]["query_name"].(string); !strings.HasSuffix(name, " egress)") {
+		t.Errorf("query_name %q does not name the direction", name)
+	}
+
+	ruleDirection, singleWindow = "both", false
+	planned, err := plannedQueries(dr.env, scope, dr.service, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, q := range planned {
+		keys = append(keys, q.key())
+	}
+	if got, want := strings.Join(keys, ","), "ingress_short_window,ingress_long_window,egress_short_window,egress_long_window"; got != want {
+		t.Errorf("planned %s, want %s", got, want)
+	}
+}
+
+func TestQueryNameCutsOnRuneBoundary(t *testing.T) {
+	app := strings.Repeat("Zürich-Ost ", 40)
+	for pad := 0; pad < 4; pad++ {
+		name := queryName("Query %s App: %s", strings.Repeat("x", pad), app)
+		if len(name) > maxQueryNameLen {
+			t.Errorf("pad %d: name is %d bytes, want at most %d", pad, len(name), maxQueryNameLen)
+		}
+		if !utf8.ValidString(name) {
+			t.Errorf("pad %d: name %q is not valid UTF-8", pad, name)
+		}
+	}
+}
+
+func TestValidatePort(t *testing.T) {
+	for _, p := range []string{"1", "443", "8443", "65535"} {
+		if err := validatePort(p); err != nil {
+			t.Errorf("validatePort(%q): %v", p, err)
+		}
+	}
+	for _, p := range []string{"", "https", "-1", "0", "65536", "99999"} {
+		if err := validatePort(p); err == nil {
+			t.Errorf("validatePort(%q): got no error", p)
+		}
+	}
+}